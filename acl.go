@@ -0,0 +1,48 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// ClientACL decides which client addresses may connect.Deny wins over Allow,
+// an empty Allow admits every address that isn't denied.A nil ClientACL
+// admits everyone.
+type ClientACL struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// Permit reports whether a client from ip may use the proxy.
+func (a *ClientACL) Permit(ip net.IP) bool {
+	if a == nil {
+		return true
+	}
+	if anyIPInNets(a.Deny, ip) {
+		return false
+	}
+	return len(a.Allow) == 0 || anyIPInNets(a.Allow, ip)
+}
+
+// ListenerOptions holds the settings of a single listener,applied on top of
+// the server wide ones.
+type ListenerOptions struct {
+	// ClientACL restricts the clients of this listener in addition to Server.ClientACL
+	ClientACL *ClientACL
+	// TLS wraps the connections of this listener,with ClientAuth set to
+	// tls.RequireAndVerifyClientCert clients authenticate by certificate
+	TLS *tls.Config
+	// CertIdentity maps a verified client certificate to the client's identity,
+	// which replaces the username/password exchange.CertSubjectIdentity if nil.
+	CertIdentity func(cert *x509.Certificate) (*Identity, error)
+}
+
+// permitClient checks addr against the server wide and the listener ACL
+func (s *Server) permitClient(addr net.Addr, opts *ListenerOptions) bool {
+	ip, _ := addrIPPort(addr)
+	if !s.ClientACL.Permit(ip) {
+		return false
+	}
+	return opts == nil || opts.ClientACL.Permit(ip)
+}
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestClientACLPermit(t *testing.T) {
+	tests := []struct {
+		name  string
+		acl   *ClientACL
+		ip    string
+		allow bool
+	}{
+		{"nil admits everyone", nil, "203.0.113.1", true},
+		{"empty admits everyone", &ClientACL{}, "203.0.113.1", true},
+		{"allowed", &ClientACL{Allow: mustParseCIDRs("203.0.113.0/24")}, "203.0.113.1", true},
+		{"not allowed", &ClientACL{Allow: mustParseCIDRs("203.0.113.0/24")}, "198.51.100.1", false},
+		{"denied", &ClientACL{Deny: mustParseCIDRs("198.51.100.0/24")}, "198.51.100.1", false},
+		{"not denied", &ClientACL{Deny: mustParseCIDRs("198.51.100.0/24")}, "203.0.113.1", true},
+		{"deny wins over allow", &ClientACL{Allow: mustParseCIDRs("10.0.0.0/8"), Deny: mustParseCIDRs("10.1.0.0/16")}, "10.1.2.3", false},
+		{"allowed outside the denied part", &ClientACL{Allow: mustParseCIDRs("10.0.0.0/8"), Deny: mustParseCIDRs("10.1.0.0/16")}, "10.2.0.1", true},
+		{"ipv6", &ClientACL{Allow: mustParseCIDRs("2001:db8::/32")}, "2001:db8::1", true},
+		{"ipv4 mapped", &ClientACL{Allow: mustParseCIDRs("203.0.113.0/24")}, "::ffff:203.0.113.1", true},
+	}
+	for _, tt := range tests {
+		if got := tt.acl.Permit(net.ParseIP(tt.ip)); got != tt.allow {
+			t.Errorf("%v: Permit(%v) = %v,want %v", tt.name, tt.ip, got, tt.allow)
+		}
+	}
+}
+
+func TestPermitClient(t *testing.T) {
+	s := newTestServer(t)
+	s.ClientACL = &ClientACL{Deny: mustParseCIDRs("198.51.100.0/24")}
+	office := &ListenerOptions{ClientACL: &ClientACL{Allow: mustParseCIDRs("203.0.113.0/24", "198.51.100.0/24")}}
+	tests := []struct {
+		name  string
+		addr  string
+		opts  *ListenerOptions
+		allow bool
+	}{
+		{"server ACL only", "192.0.2.1:5000", nil, true},
+		{"denied by the server", "198.51.100.1:5000", nil, false},
+		{"listener without ACL", "192.0.2.1:5000", &ListenerOptions{}, true},
+		{"allowed by the listener", "203.0.113.1:5000", office, true},
+		{"not allowed by the listener", "192.0.2.1:5000", office, false},
+		{"the listener can't admit what the server denies", "198.51.100.1:5000", office, false},
+	}
+	for _, tt := range tests {
+		addr, _ := net.ResolveTCPAddr("tcp", tt.addr)
+		if got := s.permitClient(addr, tt.opts); got != tt.allow {
+			t.Errorf("%v: permitClient(%v) = %v,want %v", tt.name, tt.addr, got, tt.allow)
+		}
+	}
+
+	//refused clients are disconnected before the handshake
+	s.ClientACL = &ClientACL{Deny: mustParseCIDRs("127.0.0.0/8")}
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+	client := &Client{Addr: listener.Addr().String(), Timeout: 5 * time.Second}
+	if conn, err := client.Dial("tcp", "192.0.2.1:80"); err == nil {
+		conn.Close()
+		t.Error("denied client served")
+	}
+}
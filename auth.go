@@ -1,40 +1,116 @@
 package socks5
 
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+)
+
+// AuthRequest is one authentication attempt of a client.
+type AuthRequest struct {
+	// Method is the negotiated method,AUTH_NONE or AUTH_USERNAME_PASSWORD
+	Method   int
+	Username string
+	Password string
+	Client   net.Addr
+	// Listener is the local address the client connected to
+	Listener net.Addr
+}
+
+// Identity is an authenticated client.
+type Identity struct {
+	// User is empty for anonymous clients
+	User string
+	// Policy restricts the client,nil permits everything
+	Policy *UserPolicy
+	// Attributes are extra facts the authenticator knows,e.g. an LDAP DN
+	Attributes map[string]string
+}
+
+// Authenticator checks the credentials of a client.It returns ERR_AUTH_FAILED
+// when they are wrong and other errors when it couldn't decide,ctx expires with
+// the handshake.
+type Authenticator interface {
+	Authenticate(ctx context.Context, req AuthRequest) (*Identity, error)
+}
+
+// Socks5Auth is the authenticator interface of earlier versions,Authenticate
+// is called with the user name and the password.Use LegacyAuth to plug one in.
 type Socks5Auth interface {
 	Authenticate(...interface{}) bool
 }
 
-type defAuth struct {
-	userInfo map[string]string
+// LegacyAuth adapts a Socks5Auth to Authenticator.Clients without credentials
+// are let through as before,if a implements PolicyProvider the policy of the
+// user is kept.
+func LegacyAuth(a Socks5Auth) Authenticator {
+	return legacyAuth{a}
+}
+
+type legacyAuth struct {
+	auth Socks5Auth
 }
 
-func (s *defAuth) Authenticate(b ...interface{}) bool {
-	if s.userInfo == nil {
-		return true
+func (l legacyAuth) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	if req.Method == AUTH_NONE {
+		return &Identity{}, nil
 	}
-	if len(b) != 2 {
-		return false
+	if !l.auth.Authenticate(req.Username, req.Password) {
+		return nil, ERR_AUTH_FAILED
 	}
-	user, ok := b[0].(string)
-	if !ok {
-		return false
+	id := &Identity{User: req.Username}
+	if provider, ok := l.auth.(PolicyProvider); ok {
+		id.Policy = provider.UserPolicy(req.Username)
 	}
-	pwd, ok := b[1].(string)
-	if !ok {
-		return false
+	return id, nil
+}
+
+type defAuth struct {
+	userInfo map[string]string
+	policies map[string]*UserPolicy
+}
+
+func (s *defAuth) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	if req.Method == AUTH_NONE || s.userInfo == nil {
+		return &Identity{User: req.Username}, nil
 	}
-	if s.userInfo[user] == pwd {
-		return true
+	expected, ok := s.userInfo[req.Username]
+	if !ok || subtle.ConstantTimeCompare([]byte(expected), []byte(req.Password)) != 1 {
+		return nil, ERR_AUTH_FAILED
 	}
-	return false
+	return &Identity{User: req.Username, Policy: s.UserPolicy(req.Username)}, nil
 }
 func (s *defAuth) LoadUserInfo(fn func() map[string]string) {
 	s.userInfo = fn()
 }
 
+// UserPolicy returns the policy set for user,nil if there is none
+func (s *defAuth) UserPolicy(user string) *UserPolicy {
+	return s.policies[user]
+}
+
+// SetUserPolicy sets the policy of user,nil removes it
+func (s *defAuth) SetUserPolicy(user string, policy *UserPolicy) {
+	if s.policies == nil {
+		s.policies = make(map[string]*UserPolicy)
+	}
+	if policy == nil {
+		delete(s.policies, user)
+		return
+	}
+	s.policies[user] = policy
+}
+
+// VerifyUser turns a function checking user and password into an Authenticator.
 type VerifyUser func(username, passwd string) bool
 
 //DEFAULT method 2
-func (s *VerifyUser) Authenticate(username, passwd string) bool {
-	return true
+func (f VerifyUser) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	if req.Method == AUTH_NONE {
+		return &Identity{}, nil
+	}
+	if !f(req.Username, req.Password) {
+		return nil, ERR_AUTH_FAILED
+	}
+	return &Identity{User: req.Username}, nil
 }
@@ -0,0 +1,15 @@
+package socks5
+
+import "syscall"
+
+// bindToDevice restricts the socket to a network interface
+func bindToDevice(c syscall.RawConn, device string) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import "syscall"
+
+// bindToDevice is not available,the source address alone picks the interface
+func bindToDevice(c syscall.RawConn, device string) error {
+	return nil
+}
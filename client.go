@@ -0,0 +1,231 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// replyText describes the REP field of a server reply
+var replyText = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Client connects to targets through a SOCKS5 server,e.g. another instance of
+// this one.With TLS set two instances can be chained across untrusted networks.
+type Client struct {
+	// Addr is the host:port of the server
+	Addr     string
+	Username string
+	Password string
+	// TLS speaks to the server over TLS,add a certificate to authenticate by
+	// client certificate.ServerName defaults to the host of Addr.
+	TLS *tls.Config
+	// Dialer connects to the server,a zero net.Dialer if nil
+	Dialer *net.Dialer
+	// Timeout bounds connecting and the handshake,CONNECT_TIMEOUT if zero
+	Timeout time.Duration
+}
+
+// Dial connects to addr through the server,network must be tcp.
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext connects to addr through the server,network must be tcp.
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("socks5 %v: network %v not supported", c.Addr, network)
+	}
+	conn, err := c.handshake(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.request(conn, CMD_CONNECT, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// handshake connects to the server and authenticates,the connection keeps the
+// handshake deadline
+func (c *Client) handshake(ctx context.Context) (net.Conn, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = CONNECT_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	d := c.Dialer
+	if d == nil {
+		d = &net.Dialer{}
+	}
+	conn, err := d.DialContext(ctx, "tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if c.TLS != nil {
+		config := c.TLS
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(c.Addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if err := c.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (c *Client) authenticate(conn net.Conn) error {
+	methods := []byte{AUTH_NONE}
+	if c.Username != "" {
+		methods = append(methods, AUTH_USERNAME_PASSWORD)
+	}
+	msg := append([]byte{SOCKS5VERSION, byte(len(methods))}, methods...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != SOCKS5VERSION {
+		return ERR_VERSION
+	}
+	switch reply[1] {
+	case AUTH_NONE:
+		return nil
+	case AUTH_USERNAME_PASSWORD:
+		if c.Username == "" || len(c.Username) > 255 || len(c.Password) > 255 {
+			return ERR_CLIENT_AUTH
+		}
+		msg := []byte{1, byte(len(c.Username))}
+		msg = append(msg, c.Username...)
+		msg = append(msg, byte(len(c.Password)))
+		msg = append(msg, c.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return ERR_CLIENT_AUTH
+		}
+		return nil
+	}
+	return ERR_METHOD
+}
+
+// request sends a command for addr and returns the bound address of the reply
+func (c *Client) request(conn net.Conn, cmd byte, addr string) (*net.TCPAddr, error) {
+	msg, err := appendAddr([]byte{SOCKS5VERSION, cmd, 0}, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, err
+	}
+	if head[0] != SOCKS5VERSION {
+		return nil, ERR_VERSION
+	}
+	host, port, err := readAddr(conn)
+	if err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		text := replyText[head[1]]
+		if text == "" {
+			text = "reply " + strconv.Itoa(int(head[1]))
+		}
+		return nil, &RefusedError{Proxy: "socks5 " + c.Addr, Target: addr, Reason: text}
+	}
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: port}, nil
+}
+
+// appendAddr appends ATYP,DST.ADDR and DST.PORT of a host:port
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(append(b, atypIPV4), ip4...)
+		} else {
+			b = append(append(b, atypIPV6), ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %q too long", host)
+		}
+		b = append(append(b, atypFQDN, byte(len(host))), host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readAddr reads ATYP,ADDR and PORT
+func readAddr(r io.Reader) (host string, port int, err error) {
+	atyp := make([]byte, 1)
+	if _, err = io.ReadFull(r, atyp); err != nil {
+		return
+	}
+	var body []byte
+	switch atyp[0] {
+	case atypIPV4:
+		body = make([]byte, net.IPv4len+2)
+	case atypIPV6:
+		body = make([]byte, net.IPv6len+2)
+	case atypFQDN:
+		n := make([]byte, 1)
+		if _, err = io.ReadFull(r, n); err != nil {
+			return
+		}
+		body = make([]byte, int(n[0])+2)
+	default:
+		return "", 0, ERR_ADDRESS_TYPE
+	}
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	if atyp[0] == atypFQDN {
+		host = string(body[:len(body)-2])
+	} else {
+		host = net.IP(body[:len(body)-2]).String()
+	}
+	port = int(body[len(body)-2])<<8 | int(body[len(body)-1])
+	return host, port, nil
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"os"
 
 	"github.com/realzhangliu/socks5-go"
 )
@@ -9,6 +14,157 @@ import (
 func main() {
 	//var config socks5.Config
 	//Implement yourself  Config , default is provided.
-	S5Server := socks5.NewSocks5Server(nil)
+	config, err := socks5.LoadDefaultConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		fmt.Print(socks5.HelpText)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if wsURL := os.Getenv("SOCKS5_WS_TUNNEL"); wsURL != "" {
+		runTunnel(wsURL, config.GetPort())
+		return
+	}
+	S5Server := socks5.NewSocks5Server(config)
+	if path := os.Getenv("SOCKS5_RULES"); path != "" {
+		rules, err := socks5.LoadRules(path)
+		if err != nil {
+			log.Fatalf("load rules %v: %v", path, err)
+		}
+		S5Server.Rules = rules
+	}
+	if text := os.Getenv("SOCKS5_BANDWIDTH_CLASSES"); text != "" {
+		classes, err := socks5.ParseBandwidthClasses(text)
+		if err != nil {
+			log.Fatalf("SOCKS5_BANDWIDTH_CLASSES: %v", err)
+		}
+		S5Server.BandwidthClasses = classes
+	}
+	if list := os.Getenv("SOCKS5_EGRESS_ALLOW"); list != "" {
+		nets, err := socks5.ParseCIDRs(list)
+		if err != nil {
+			log.Fatalf("SOCKS5_EGRESS_ALLOW: %v", err)
+		}
+		S5Server.Egress.Allowed = nets
+	}
+	if allow, deny := os.Getenv("SOCKS5_CLIENT_ALLOW"), os.Getenv("SOCKS5_CLIENT_DENY"); allow != "" || deny != "" {
+		acl := &socks5.ClientACL{}
+		var err error
+		if acl.Allow, err = socks5.ParseCIDRs(allow); err != nil {
+			log.Fatalf("SOCKS5_CLIENT_ALLOW: %v", err)
+		}
+		if acl.Deny, err = socks5.ParseCIDRs(deny); err != nil {
+			log.Fatalf("SOCKS5_CLIENT_DENY: %v", err)
+		}
+		S5Server.ClientACL = acl
+	}
+	if text := os.Getenv("SOCKS5_AUTH_THROTTLE"); text != "" {
+		throttle, err := socks5.ParseAuthThrottle(text)
+		if err != nil {
+			log.Fatalf("SOCKS5_AUTH_THROTTLE: %v", err)
+		}
+		S5Server.AuthThrottle = throttle
+	}
+	if text := os.Getenv("SOCKS5_UPSTREAM"); text != "" {
+		chain, err := socks5.ParseProxyChain(text)
+		if err != nil {
+			log.Fatalf("SOCKS5_UPSTREAM: %v", err)
+		}
+		chain.LocalDNS = os.Getenv("SOCKS5_UPSTREAM_LOCAL_DNS") == "1"
+		S5Server.Upstream = chain
+	}
+	if path := os.Getenv("SOCKS5_ROUTES"); path != "" {
+		router, err := socks5.LoadRoutes(path)
+		if err != nil {
+			log.Fatalf("load routes %v: %v", path, err)
+		}
+		S5Server.Router = router
+	}
+	if path := os.Getenv("SOCKS5_REWRITES"); path != "" {
+		rewriter, err := socks5.LoadRewrites(path)
+		if err != nil {
+			log.Fatalf("load rewrites %v: %v", path, err)
+		}
+		S5Server.Rewriter = rewriter
+	}
+	if text := os.Getenv("SOCKS5_EGRESS_SOURCE"); text != "" {
+		source, err := socks5.ParseEgressSource(text)
+		if err != nil {
+			log.Fatalf("SOCKS5_EGRESS_SOURCE: %v", err)
+		}
+		S5Server.Source = source
+	}
+	var opts *socks5.ListenerOptions
+	if cert, key := os.Getenv("SOCKS5_TLS_CERT"), os.Getenv("SOCKS5_TLS_KEY"); cert != "" {
+		certs, err := socks5.NewCertReloader(cert, key)
+		if err != nil {
+			log.Fatalf("SOCKS5_TLS_CERT: %v", err)
+		}
+		certs.Watch(socks5.CERT_FILE_CHECK_INTERVAL)
+		config, err := socks5.NewTLSConfig(certs, os.Getenv("SOCKS5_TLS_CLIENT_CA"))
+		if err != nil {
+			log.Fatalf("SOCKS5_TLS_CLIENT_CA: %v", err)
+		}
+		opts = &socks5.ListenerOptions{TLS: config}
+	}
+	if addr := os.Getenv("SOCKS5_WS_LISTEN"); addr != "" {
+		path := os.Getenv("SOCKS5_WS_PATH")
+		if path == "" {
+			path = "/socks"
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatalf("SOCKS5_WS_LISTEN: %v", err)
+		}
+		go func() {
+			log.Println(S5Server.ServeWebSocket(listener, path, opts))
+		}()
+	}
+	if text := os.Getenv("SOCKS5_FORWARDS"); text != "" {
+		forwards, err := socks5.ParseForwards(text)
+		if err != nil {
+			log.Fatalf("SOCKS5_FORWARDS: %v", err)
+		}
+		for _, f := range forwards {
+			go func(f *socks5.Forward) {
+				log.Fatalf("forward %v/%v: %v", f.Network, f.Listen, S5Server.ListenForward(f))
+			}(f)
+		}
+	}
+	if opts != nil {
+		log.Println(S5Server.ListenTLS(opts.TLS))
+		return
+	}
 	log.Println(S5Server.Listen())
 }
+
+// runTunnel exposes a plain SOCKS port that forwards to a WebSocket listener
+func runTunnel(wsURL, port string) {
+	tunnel := &socks5.WebSocketTunnel{URL: wsURL}
+	//HTTPS_PROXY,HTTP_PROXY and NO_PROXY pick the corporate proxy
+	req, err := http.NewRequest(http.MethodGet, wsURL, nil)
+	if err != nil {
+		log.Fatalf("SOCKS5_WS_TUNNEL: %v", err)
+	}
+	if req.URL.Scheme == "wss" {
+		req.URL.Scheme = "https"
+	} else {
+		req.URL.Scheme = "http"
+	}
+	//a proxy the tunnel can't use is skipped,not fatal
+	if tunnel.Proxy, err = http.ProxyFromEnvironment(req); err != nil {
+		log.Printf("ignoring the proxy from the environment: %v", err)
+		tunnel.Proxy = nil
+	} else if tunnel.Proxy != nil {
+		if _, err := socks5.ParseProxyChain(tunnel.Proxy.String()); err != nil {
+			log.Printf("ignoring the proxy from the environment: %v", err)
+			tunnel.Proxy = nil
+		}
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatalf("SOCKS5_WS_TUNNEL: %v", err)
+	}
+	log.Println(tunnel.Serve(listener))
+}
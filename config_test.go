@@ -0,0 +1,87 @@
+package socks5
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetUserPolicy(t *testing.T) {
+	noAuth := &defConfig{defAuth: &defAuth{}}
+	if err := noAuth.setUserPolicy("cmd=connect", "alice", false); err == nil {
+		t.Error("a policy without authentication must be refused")
+	}
+	if err := noAuth.setUserPolicy("cmd=connect", "alice", true); err != nil {
+		t.Errorf("certificate users may carry a policy: %v", err)
+	}
+
+	backend := &defConfig{defAuth: &defAuth{}}
+	backend.SetAuthenticator(VerifyUser(func(user, pwd string) bool { return pwd == "secret" }))
+	if err := backend.setUserPolicy("cmd=connect", "", false); err == nil {
+		t.Error("a policy without a user must be refused")
+	}
+	if err := backend.setUserPolicy("cmd=bogus", "alice", false); err == nil {
+		t.Error("an invalid policy must be refused")
+	}
+	if err := backend.setUserPolicy("cmd=connect;max_sessions=2", "alice", false); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := backend.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "alice", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Policy == nil || identity.Policy.MaxSessions != 2 {
+		t.Errorf("policy of alice not applied: %+v", identity.Policy)
+	}
+	if backend.UserPolicy("alice") == nil {
+		t.Error("UserPolicy must return the policy,e.g. for certificate users")
+	}
+	identity, err = backend.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "bob", Password: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Policy != nil {
+		t.Errorf("bob got a policy: %+v", identity.Policy)
+	}
+	if _, err := backend.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "alice", Password: "wrong"}); err != ERR_AUTH_FAILED {
+		t.Errorf("wrong password: %v", err)
+	}
+
+	builtin := &defConfig{defAuth: &defAuth{userInfo: map[string]string{"carol": "pw"}}, hasAuth: true}
+	if err := builtin.setUserPolicy("cmd=udp", "", false); err != nil {
+		t.Fatal(err)
+	}
+	identity, err = builtin.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "carol", Password: "pw"})
+	if err != nil || identity.Policy == nil || identity.Policy.allowCommand(CMD_CONNECT) {
+		t.Errorf("policy of carol not applied: %+v %v", identity, err)
+	}
+}
+
+func TestLoadDefaultConfig(t *testing.T) {
+	if _, err := LoadDefaultConfig([]string{"--help"}); err != flag.ErrHelp {
+		t.Errorf("--help: got %v,want flag.ErrHelp", err)
+	}
+	config, err := LoadDefaultConfig([]string{"2080", "alice", "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.GetPort() != "2080" || !config.HasAuth() {
+		t.Errorf("port %v,auth %v", config.GetPort(), config.HasAuth())
+	}
+	if _, err := config.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "alice", Password: "secret"}); err != nil {
+		t.Errorf("alice refused: %v", err)
+	}
+
+	//a bad users file is an error,not the end of the process
+	os.Setenv("SOCKS5_USERS_FILE", filepath.Join(t.TempDir(), "missing"))
+	defer os.Unsetenv("SOCKS5_USERS_FILE")
+	if _, err := LoadDefaultConfig(nil); err == nil || !strings.HasPrefix(err.Error(), "SOCKS5_USERS_FILE") {
+		t.Errorf("got %v,want an error for SOCKS5_USERS_FILE", err)
+	}
+	if DefaultConfig.GetPort() != "1080" || DefaultConfig.HasAuth() {
+		t.Errorf("DefaultConfig changed: %+v", DefaultConfig)
+	}
+}
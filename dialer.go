@@ -0,0 +1,59 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// Dialer connects to destinations for clients,see Server.Dialer.*net.Dialer
+// implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// PacketDialer opens the sockets UDP datagrams are relayed through,see
+// Server.PacketDialer.The network is "udp" and the connection exchanges
+// datagrams with addr only.*net.Dialer implements it.
+type PacketDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialRequest is the client request a connection is dialed for,custom
+// dialers get it with RequestFromContext.
+type DialRequest struct {
+	// Command is CMD_CONNECT or CMD_UDP_ASSOCIATE
+	Command int
+	// User and Identity are those of the authenticated client,empty and nil
+	// without authentication
+	User     string
+	Identity *Identity
+	Client   net.Addr
+	// Domain is the host name the client asked for,or the one it was
+	// rewritten to,empty for addresses
+	Domain string
+	// Outbound is the one Server.Router picked,nil for the server default
+	Outbound *Outbound
+}
+
+type dialRequestKey struct{}
+
+// ContextWithRequest returns a copy of ctx carrying req.
+func ContextWithRequest(ctx context.Context, req *DialRequest) context.Context {
+	return context.WithValue(ctx, dialRequestKey{}, req)
+}
+
+// RequestFromContext returns the request a dial is made for,nil if ctx
+// carries none.
+func RequestFromContext(ctx context.Context) *DialRequest {
+	req, _ := ctx.Value(dialRequestKey{}).(*DialRequest)
+	return req
+}
+
+// dialContext returns the context for the dials of req,bounded by ConnectTimeout
+func (s *Server) dialContext(req *DialRequest) (context.Context, context.CancelFunc) {
+	ctx := ContextWithRequest(context.Background(), req)
+	if s.ConnectTimeout > 0 {
+		return context.WithTimeout(ctx, s.ConnectTimeout)
+	}
+	return context.WithCancel(ctx)
+}
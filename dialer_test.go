@@ -0,0 +1,52 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestDialCustomResolvesOnce checks that Server.Dialer gets the addresses the
+// egress guard checked,not a name it could resolve to somewhere else
+func TestDialCustomResolvesOnce(t *testing.T) {
+	s := newTestServer(t)
+	var dialed []string
+	s.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		if req := RequestFromContext(ctx); req == nil {
+			t.Error("no request in the dial context")
+		}
+		return nil, errors.New("unreachable")
+	})
+	conn := &TCPConn{server: s}
+	if _, err := conn.DialHost("localhost:80"); err == nil {
+		t.Fatal("dial succeeded")
+	}
+	if len(dialed) == 0 {
+		t.Fatal("dialer not called")
+	}
+	for _, addr := range dialed {
+		host, _, _ := net.SplitHostPort(addr)
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			t.Errorf("dialer got %v,want a checked loopback address", addr)
+		}
+	}
+
+	//every address is checked before any is dialed
+	dialed = nil
+	s.Egress = NewEgressGuard()
+	if _, err := conn.DialHost("localhost:80"); !errors.Is(err, ERR_EGRESS_BLOCKED) {
+		t.Errorf("got %v,want ERR_EGRESS_BLOCKED", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("blocked name dialed as %v", dialed)
+	}
+
+	//without the guard the name is left to the dialer
+	s.Egress = nil
+	conn.DialHost("localhost:80")
+	if len(dialed) != 1 || dialed[0] != "localhost:80" {
+		t.Errorf("dialed %v,want the name", dialed)
+	}
+}
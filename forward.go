@@ -0,0 +1,245 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Forward relays raw TCP or UDP traffic arriving on a local port to a fixed
+// target,without any SOCKS handshake.
+type Forward struct {
+	// Network is "tcp" or "udp"
+	Network string
+	// Listen is the local address,e.g. ":2222"
+	Listen string
+	// Target is the host:port the traffic goes to
+	Target string
+	// Route sends the traffic like a request for Target,through Server.Router
+	// or Upstream and checked by the egress guard.Otherwise Target is dialed
+	// directly,it is set by the operator and not checked.
+	Route bool
+	// ClientACL restricts the clients of this forward in addition to Server.ClientACL
+	ClientACL *ClientACL
+}
+
+// ParseForwards parses comma separated forwards,network/listen=target with
+// "/route" appended for Forward.Route:
+//
+//	tcp/:2222=10.0.0.5:22,udp/:5353=10.0.0.53:53,tcp/127.0.0.1:8443=api.example.com:443/route
+func ParseForwards(text string) ([]*Forward, error) {
+	var forwards []*Forward
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		f := &Forward{}
+		kv := strings.SplitN(item, "=", 2)
+		parts := strings.SplitN(kv[0], "/", 2)
+		if len(kv) != 2 || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid forward %q", item)
+		}
+		f.Network, f.Listen, f.Target = strings.ToLower(parts[0]), parts[1], kv[1]
+		if strings.HasSuffix(f.Target, "/route") {
+			f.Target, f.Route = strings.TrimSuffix(f.Target, "/route"), true
+		}
+		if f.Network != "tcp" && f.Network != "udp" {
+			return nil, fmt.Errorf("forward %q: unsupported network %q", item, parts[0])
+		}
+		if _, _, err := net.SplitHostPort(f.Listen); err != nil {
+			return nil, fmt.Errorf("forward %q: %v", item, err)
+		}
+		if _, port, err := net.SplitHostPort(f.Target); err != nil {
+			return nil, fmt.Errorf("forward %q: %v", item, err)
+		} else if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 0xffff {
+			return nil, fmt.Errorf("forward %q: invalid port %q", item, port)
+		}
+		forwards = append(forwards, f)
+	}
+	if len(forwards) == 0 {
+		return nil, fmt.Errorf("no forwards in %q", text)
+	}
+	return forwards, nil
+}
+
+// ListenForward listens on f.Listen and forwards the traffic of every client
+// to f.Target until the listener fails.The clients show up as sessions,the
+// hooks OnConnected and OnClose are called for them.
+func (s *Server) ListenForward(f *Forward) error {
+	opts := &ListenerOptions{ClientACL: f.ClientACL}
+	if f.Network == "udp" {
+		addr, err := net.ResolveUDPAddr("udp", f.Listen)
+		if err != nil {
+			return err
+		}
+		relayConn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		defer relayConn.Close()
+		s.Egress.addListener(relayConn.LocalAddr())
+		log.Printf("UDP FORWARD %v -> %v\n", relayConn.LocalAddr(), f.Target)
+		for {
+			b := make([]byte, MAXUDPDATA)
+			n, clientAddr, err := relayConn.ReadFromUDP(b)
+			if err != nil {
+				return err
+			}
+			if !s.permitClient(clientAddr, opts) {
+				continue
+			}
+			go s.forwardUDP(relayConn, f, clientAddr, b[:n])
+		}
+	}
+	listener, err := net.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	s.Egress.addListener(listener.Addr())
+	log.Printf("TCP FORWARD %v -> %v\n", listener.Addr(), f.Target)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if !s.permitClient(conn.RemoteAddr(), opts) {
+			log.Printf("CLIENT %v REFUSED BY ACL\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		tConn := &TCPConn{
+			server: s,
+			id:     s.Sessions.NewID(),
+			conn:   conn,
+		}
+		go tConn.forwardTCP(conn, f)
+	}
+}
+
+// forwardTCP relays a client of a TCP forward to its target
+func (s *TCPConn) forwardTCP(conn net.Conn, f *Forward) {
+	defer conn.Close()
+	req := &TCPRequest{
+		clientAddr: tcpAddr(conn.RemoteAddr()),
+		cmd:        CMD_CONNECT,
+	}
+	s.request = req
+	if err := s.retarget(req, f.Target); err != nil {
+		log.Printf("[ID:%v]FORWARD %v: %v\n", s.ID(), f.Target, err)
+		return
+	}
+	var targetConn net.Conn
+	var err error
+	if f.Route {
+		targetConn, err = s.dialTarget(req)
+	} else {
+		targetConn, err = s.dialForward(f.Target)
+	}
+	if err != nil {
+		log.Printf("[ID:%v]FORWARD dial %v failed: %v\n", s.ID(), f.Target, err)
+		return
+	}
+	defer targetConn.Close()
+	for _, c := range []net.Conn{conn, targetConn} {
+		if tcpConn, ok := c.(*net.TCPConn); ok {
+			if err := setTCPOptions(tcpConn); err != nil {
+				log.Printf("[ID:%v]Failed to set TCP options: %v\n", s.ID(), err)
+			}
+		}
+	}
+	log.Printf("[ID:%v]FORWARD %v -> %v\n", s.ID(), conn.RemoteAddr(), f.Target)
+	req.TargetConn = targetConn
+	session := s.registerSession(conn, req)
+	defer s.server.Sessions.Remove(session.ID)
+	s.server.hookConnected(session)
+	sent, received := s.TCPTransport(conn, targetConn, session)
+	s.server.hookClose(session)
+	log.Printf("[ID:%v][TCP]FORWARD CLOSED client sent %v bytes,remote sent %v bytes\n", s.ID(), sent, received)
+}
+
+// dialForward connects to the target of a direct forward
+func (s *TCPConn) dialForward(hostport string) (net.Conn, error) {
+	if s.server.Dialer != nil {
+		ctx, cancel := s.server.dialContext(s.dialRequest(directOutbound))
+		defer cancel()
+		return s.server.Dialer.DialContext(ctx, "tcp", hostport)
+	}
+	d := s.server.tcpDialer(nil)
+	if err := s.server.Source.apply(&d, "tcp", s.listenerIP(), nil); err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", hostport)
+}
+
+// forwardUDP relays a datagram of a UDP forward,the first one of a client sets
+// up its relay and session
+func (s *Server) forwardUDP(relayConn *net.UDPConn, f *Forward, clientAddr *net.UDPAddr, b []byte) {
+	host, portStr, _ := net.SplitHostPort(f.Target)
+	port, _ := strconv.Atoi(portStr)
+	target := &udpTarget{reply: &net.UDPAddr{IP: net.ParseIP(host), Port: port}, raw: true}
+	if target.reply.IP == nil {
+		target.domain = host
+	}
+	s.locker.RLock()
+	request := s.UDPRequestMap[target.key(relayConn, clientAddr)]
+	s.locker.RUnlock()
+	if request == nil {
+		var err error
+		if request, err = s.forwardUDPRequest(relayConn, f, clientAddr, target); err != nil {
+			log.Printf("[UDP]FORWARD client:%v -> remote:%v %v\n", clientAddr, f.Target, err)
+			return
+		}
+	}
+	request.write(b)
+	atomic.AddInt64(&request.session.bytesSent, int64(len(b)))
+}
+
+// forwardUDPRequest sets up the relay of a new client of a UDP forward
+func (s *Server) forwardUDPRequest(relayConn *net.UDPConn, f *Forward, clientAddr *net.UDPAddr, target *udpTarget) (*UDPRequest, error) {
+	target.remote = target.reply
+	if target.domain != "" {
+		addrs, err := net.LookupIP(target.domain)
+		if err != nil {
+			return nil, err
+		}
+		target.remote = &net.UDPAddr{IP: addrs[0], Port: target.reply.Port}
+	}
+	out := directOutbound
+	if f.Route {
+		if err := s.Egress.Check(target.remote.IP, target.remote.Port); err != nil {
+			return nil, err
+		}
+		out = s.Router.Route(&RuleRequest{
+			Command: CMD_UDP_ASSOCIATE,
+			Domain:  target.domain,
+			IPs:     []net.IP{target.remote.IP},
+			Port:    target.remote.Port,
+			Client:  clientAddr.IP,
+		})
+		if out != nil && out.Type == OutboundBlock {
+			return nil, ERR_ROUTE_BLOCKED
+		}
+	}
+	session := &Session{
+		ID:      s.Sessions.NewID(),
+		Command: CMD_UDP_ASSOCIATE,
+		Client:  clientAddr,
+		Target:  target.remote,
+		Start:   time.Now(),
+	}
+	request, err := s.udpRequest(relayConn, session, out, clientAddr, target)
+	if err != nil {
+		return nil, err
+	}
+	if request.session == session {
+		s.Sessions.Add(session)
+		s.hookConnected(session)
+		log.Printf("[ID:%v][UDP]FORWARD %v -> %v\n", session.ID, clientAddr, f.Target)
+	}
+	return request, nil
+}
@@ -0,0 +1,51 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func listenUDPTest(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestForwardUDPAfterStart relays a datagram of a UDP forward right after the
+// server was created,when the UDP relay of UDP ASSOCIATE may not run yet
+func TestForwardUDPAfterStart(t *testing.T) {
+	echo := listenUDPTest(t)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, MAXUDPDATA)
+		for {
+			n, addr, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], addr)
+		}
+	}()
+	relayConn := listenUDPTest(t)
+	defer relayConn.Close()
+	client := listenUDPTest(t)
+	defer client.Close()
+
+	s := newTestServer(t)
+	f := &Forward{Network: "udp", Listen: relayConn.LocalAddr().String(), Target: echo.LocalAddr().String()}
+	s.forwardUDP(relayConn, f, client.LocalAddr().(*net.UDPAddr), []byte("ping"))
+
+	//the echo comes back to the client from the forward's port
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, MAXUDPDATA)
+	n, from, err := client.ReadFromUDP(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b[:n]) != "ping" || from.String() != relayConn.LocalAddr().String() {
+		t.Errorf("got %q from %v", b[:n], from)
+	}
+}
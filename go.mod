@@ -2,4 +2,9 @@ module github.com/realzhangliu/socks5-go
 
 go 1.12
 
-require github.com/pkg/errors v0.9.1 // indirect
+require (
+	github.com/go-asn1-ber/asn1-ber v1.3.1
+	github.com/go-ldap/ldap/v3 v3.1.10
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+)
@@ -0,0 +1,223 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+// DefaultBlockedNets are the destinations an EgressGuard refuses unless they
+// are explicitly allowed: loopback,private (RFC 1918/4193),carrier-grade NAT,
+// link-local (including cloud metadata at 169.254.169.254),multicast and
+// reserved ranges.NAT64 (RFC 6052/8215) and 6to4 addresses are blocked as a
+// whole,they embed IPv4 addresses that may be internal.IPv4-mapped IPv6
+// addresses are matched like the IPv4 addresses they carry.
+var DefaultBlockedNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"64:ff9b:1::/48",
+	"2002::/16",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+// EgressGuard keeps clients from reaching internal destinations through the
+// proxy.Addresses are checked after DNS resolution,right before every
+// connection attempt and for every UDP datagram,so a name that rebinds to an
+// internal address is still refused.
+type EgressGuard struct {
+	// Disabled turns the guard off
+	Disabled bool
+	// Blocked replaces DefaultBlockedNets when set
+	Blocked []*net.IPNet
+	// Allowed overrides Blocked,the proxy's own listeners stay unreachable
+	Allowed []*net.IPNet
+
+	locker    sync.RWMutex
+	listeners []net.Addr
+	localIPs  []net.IP
+}
+
+// NewEgressGuard returns a guard blocking DefaultBlockedNets.
+func NewEgressGuard() *EgressGuard {
+	return &EgressGuard{}
+}
+
+// Check returns ERR_EGRESS_BLOCKED if ip:port may not be reached.
+func (g *EgressGuard) Check(ip net.IP, port int) error {
+	if g == nil || g.Disabled {
+		return nil
+	}
+	if g.isListener(ip, port) {
+		return ERR_EGRESS_BLOCKED
+	}
+	if anyIPInNets(g.Allowed, ip) {
+		return nil
+	}
+	blocked := g.Blocked
+	if blocked == nil {
+		blocked = DefaultBlockedNets
+	}
+	if anyIPInNets(blocked, ip) {
+		return ERR_EGRESS_BLOCKED
+	}
+	return nil
+}
+
+// checkHost checks every address of host:port,a host name is resolved unless
+// resolve is false,then it is left to whoever dials it
+func (g *EgressGuard) checkHost(ctx context.Context, hostport string, resolve bool) error {
+	if g == nil || g.Disabled {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	if ip := net.ParseIP(host); ip != nil {
+		return g.Check(ip, port)
+	}
+	if !resolve {
+		return nil
+	}
+	_, err = g.resolveHost(ctx, hostport)
+	return err
+}
+
+// resolveHost checks every address of host:port and returns them to be dialed
+// in turn,so the name isn't resolved again,maybe to another address,after the
+// check.host:port is returned as is with the guard off.
+func (g *EgressGuard) resolveHost(ctx context.Context, hostport string) ([]string, error) {
+	if g == nil || g.Disabled {
+		return []string{hostport}, nil
+	}
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	if ip := net.ParseIP(host); ip != nil {
+		return []string{hostport}, g.Check(ip, port)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	checked := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if err := g.Check(addr.IP, port); err != nil {
+			return nil, err
+		}
+		checked = append(checked, net.JoinHostPort(addr.String(), portStr))
+	}
+	return checked, nil
+}
+
+// control is a net.Dialer Control function checking every address dialed
+func (g *EgressGuard) control(network, address string, c syscall.RawConn) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, _ := strconv.Atoi(portStr)
+	return g.Check(net.ParseIP(host), port)
+}
+
+// isListener reports whether ip:port is one of the proxy's own listeners
+func (g *EgressGuard) isListener(ip net.IP, port int) bool {
+	g.locker.RLock()
+	defer g.locker.RUnlock()
+	for _, addr := range g.listeners {
+		lIP, lPort := addrIPPort(addr)
+		if lPort != port {
+			continue
+		}
+		if lIP.Equal(ip) {
+			return true
+		}
+		if lIP.IsUnspecified() {
+			for _, local := range g.localIPs {
+				if local.Equal(ip) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// rewritten returns the guard for destinations a Rewriter picked,they were
+// set by the operator and are often internal,so only the proxy's own
+// listeners stay unreachable
+func (g *EgressGuard) rewritten() *EgressGuard {
+	if g == nil || g.Disabled {
+		return g
+	}
+	g.locker.RLock()
+	defer g.locker.RUnlock()
+	return &EgressGuard{Blocked: []*net.IPNet{}, listeners: g.listeners, localIPs: g.localIPs}
+}
+
+// addListener records a listener of the proxy so it can't be used as a destination
+func (g *EgressGuard) addListener(addr net.Addr) {
+	if g == nil {
+		return
+	}
+	g.locker.Lock()
+	defer g.locker.Unlock()
+	g.listeners = append(g.listeners, addr)
+	if ip, _ := addrIPPort(addr); ip != nil && ip.IsUnspecified() && g.localIPs == nil {
+		ifAddrs, _ := net.InterfaceAddrs()
+		for _, a := range ifAddrs {
+			if n, ok := a.(*net.IPNet); ok {
+				g.localIPs = append(g.localIPs, n.IP)
+			}
+		}
+	}
+}
+
+// addrIPPort returns the IP and port of a TCP or UDP address,nil and 0 for
+// others,e.g. those of in-memory connections
+func addrIPPort(addr net.Addr) (net.IP, int) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP, a.Port
+	case *net.UDPAddr:
+		return a.IP, a.Port
+	}
+	return nil, 0
+}
+
+// tcpAddr is addr as a TCP address,0.0.0.0:0 if it has no IP and port
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	ip, port := addrIPPort(addr)
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
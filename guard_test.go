@@ -0,0 +1,98 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestEgressGuardCheck(t *testing.T) {
+	guard := NewEgressGuard()
+	tests := []struct {
+		ip      string
+		blocked bool
+	}{
+		{"93.184.216.34", false},
+		{"2606:2800:220:1:248:1893:25c8:1946", false},
+		{"10.1.2.3", true},
+		{"127.0.0.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		//IPv4-mapped
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:10.0.0.1", true},
+		{"::ffff:93.184.216.34", false},
+		//NAT64
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::7f00:1", true},
+		{"64:ff9b:1::a00:1", true},
+		//6to4
+		{"2002:7f00:1::1", true},
+		{"2002:a9fe:a9fe::1", true},
+	}
+	for _, tt := range tests {
+		err := guard.Check(net.ParseIP(tt.ip), 443)
+		if blocked := err == ERR_EGRESS_BLOCKED; blocked != tt.blocked {
+			t.Errorf("Check(%v) = %v,want blocked %v", tt.ip, err, tt.blocked)
+		}
+	}
+}
+
+func TestEgressGuardAllowAndDisable(t *testing.T) {
+	guard := NewEgressGuard()
+	guard.Allowed = mustParseCIDRs("10.0.0.0/24")
+	if err := guard.Check(net.ParseIP("10.0.0.5"), 80); err != nil {
+		t.Errorf("allowed address refused: %v", err)
+	}
+	if err := guard.Check(net.ParseIP("10.0.1.5"), 80); err != ERR_EGRESS_BLOCKED {
+		t.Errorf("address outside Allowed passed: %v", err)
+	}
+	guard.Blocked = mustParseCIDRs("198.51.100.0/24")
+	if err := guard.Check(net.ParseIP("10.0.1.5"), 80); err != nil {
+		t.Errorf("Blocked should replace the defaults: %v", err)
+	}
+	guard.Disabled = true
+	if err := guard.Check(net.ParseIP("198.51.100.1"), 80); err != nil {
+		t.Errorf("disabled guard refused: %v", err)
+	}
+	var nilGuard *EgressGuard
+	if err := nilGuard.Check(net.ParseIP("127.0.0.1"), 80); err != nil {
+		t.Errorf("nil guard refused: %v", err)
+	}
+}
+
+func TestEgressGuardListeners(t *testing.T) {
+	guard := NewEgressGuard()
+	guard.Allowed = mustParseCIDRs("127.0.0.0/8")
+	guard.addListener(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1080})
+	if err := guard.Check(net.ParseIP("127.0.0.1"), 1080); err != ERR_EGRESS_BLOCKED {
+		t.Errorf("own listener reachable: %v", err)
+	}
+	if err := guard.Check(net.ParseIP("127.0.0.1"), 8080); err != nil {
+		t.Errorf("allowed port refused: %v", err)
+	}
+}
+
+func TestEgressGuardCheckHost(t *testing.T) {
+	guard := NewEgressGuard()
+	ctx := context.Background()
+	if err := guard.checkHost(ctx, "[64:ff9b::a9fe:a9fe]:80", true); err != ERR_EGRESS_BLOCKED {
+		t.Errorf("NAT64 literal passed: %v", err)
+	}
+	if err := guard.checkHost(ctx, "localhost:80", true); err != ERR_EGRESS_BLOCKED {
+		t.Errorf("localhost passed: %v", err)
+	}
+	if err := guard.checkHost(ctx, "192.0.2.1:80", true); err != nil {
+		t.Errorf("public address refused: %v", err)
+	}
+	//names left to an upstream proxy aren't looked up,addresses are still checked
+	if err := guard.checkHost(ctx, "localhost:80", false); err != nil {
+		t.Errorf("unresolved name checked: %v", err)
+	}
+	if err := guard.checkHost(ctx, "127.0.0.1:80", false); err != ERR_EGRESS_BLOCKED {
+		t.Errorf("loopback literal passed: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"net"
+	"time"
+)
+
+// Hooks observe and steer the sessions of a server,e.g. for auditing or
+// custom policy.Every field may be nil.Hooks registered with Server.AddHooks
+// run in order,the first error decides.They are called on the goroutine
+// serving the client,a slow hook holds up that client.
+type Hooks struct {
+	// OnAccept is called for every connection the client ACL lets through,
+	// an error closes it
+	OnAccept func(conn net.Conn) error
+	// OnAuth is called when a client has authenticated,or failed to with err.
+	// The password is not passed on.An error refuses an authenticated client.
+	OnAuth func(req AuthRequest, identity *Identity, err error) error
+	// OnRequest is called for every request before the access rules,it may
+	// set req.Target to another destination or deny the request with an error
+	OnRequest func(req *HookRequest) error
+	// OnConnected is called once a session is set up,before data is relayed
+	OnConnected func(session *Session)
+	// OnClose is called when a session ends with the bytes sent by the client
+	// and by the target
+	OnClose func(session *Session, sent, received int64, duration time.Duration)
+	// OnUDPDatagram is called for every datagram a client sends once the
+	// access rules passed it,size is that of the payload.An error drops it.
+	OnUDPDatagram func(session *Session, target *net.UDPAddr, domain string, size int) error
+}
+
+// HookRequest is a client request as seen by Hooks.OnRequest.
+type HookRequest struct {
+	// Command is CMD_CONNECT,CMD_BIND or CMD_UDP_ASSOCIATE
+	Command  int
+	User     string
+	Identity *Identity
+	Client   net.Addr
+	// Target is the requested host:port,with the host name if the client sent
+	// one.For UDP ASSOCIATE it is the address the client will send from.
+	Target string
+}
+
+// AddHooks registers h,hooks should be added before the server is started.
+func (s *Server) AddHooks(h *Hooks) {
+	s.hooks = append(s.hooks, h)
+}
+
+func (s *Server) hookAccept(conn net.Conn) error {
+	for _, h := range s.hooks {
+		if h.OnAccept != nil {
+			if err := h.OnAccept(conn); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) hookAuth(req AuthRequest, identity *Identity, authErr error) error {
+	req.Password = ""
+	for _, h := range s.hooks {
+		if h.OnAuth != nil {
+			if err := h.OnAuth(req, identity, authErr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) hookRequest(req *HookRequest) error {
+	for _, h := range s.hooks {
+		if h.OnRequest != nil {
+			if err := h.OnRequest(req); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) hookConnected(session *Session) {
+	for _, h := range s.hooks {
+		if h.OnConnected != nil {
+			h.OnConnected(session)
+		}
+	}
+}
+
+func (s *Server) hookClose(session *Session) {
+	duration := time.Since(session.Start)
+	for _, h := range s.hooks {
+		if h.OnClose != nil {
+			h.OnClose(session, session.BytesSent(), session.BytesReceived(), duration)
+		}
+	}
+}
+
+func (s *Server) hookUDPDatagram(session *Session, target *net.UDPAddr, domain string, size int) error {
+	for _, h := range s.hooks {
+		if h.OnUDPDatagram != nil {
+			if err := h.OnUDPDatagram(session, target, domain, size); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// pipeCONNECT sends a CONNECT for 192.0.2.1:80 to s over an in-memory
+// connection and returns it with the REP of the reply
+func pipeCONNECT(t *testing.T, s *Server) (net.Conn, byte) {
+	client, server := net.Pipe()
+	go (&TCPConn{server: s, conn: server}).ServConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte{SOCKS5VERSION, 1, AUTH_NONE}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil || method[1] != AUTH_NONE {
+		t.Fatalf("method %v: %v", method, err)
+	}
+	if _, err := client.Write([]byte{SOCKS5VERSION, CMD_CONNECT, 0, atypIPV4, 192, 0, 2, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	return client, reply[1]
+}
+
+// pipeTarget makes s dial in-memory targets that read the given bytes and
+// answer with answer,the dialed addresses are sent to dialed
+func pipeTarget(s *Server, dialed chan<- string, answer string, read int) {
+	s.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		conn, target := net.Pipe()
+		go func() {
+			defer target.Close()
+			io.ReadFull(target, make([]byte, read))
+			target.Write([]byte(answer))
+		}()
+		return conn, nil
+	})
+}
+
+func TestHookRequestDeny(t *testing.T) {
+	s := newTestServer(t)
+	dialed := make(chan string, 1)
+	pipeTarget(s, dialed, "", 0)
+	var got *HookRequest
+	s.AddHooks(&Hooks{OnRequest: func(req *HookRequest) error {
+		got = req
+		return errors.New("not today")
+	}})
+	client, rep := pipeCONNECT(t, s)
+	defer client.Close()
+	if rep != 2 {
+		t.Errorf("reply %v,want 2 (not allowed)", rep)
+	}
+	if got == nil || got.Command != CMD_CONNECT || got.Target != "192.0.2.1:80" {
+		t.Errorf("hook got %+v", got)
+	}
+	select {
+	case addr := <-dialed:
+		t.Errorf("denied request dialed %v", addr)
+	default:
+	}
+}
+
+func TestHookRequestRewrite(t *testing.T) {
+	s := newTestServer(t)
+	dialed := make(chan string, 1)
+	pipeTarget(s, dialed, "rewritten", 0)
+	s.AddHooks(&Hooks{OnRequest: func(req *HookRequest) error {
+		req.Target = "192.0.2.9:8080"
+		return nil
+	}})
+	client, rep := pipeCONNECT(t, s)
+	defer client.Close()
+	if rep != 0 {
+		t.Fatalf("reply %v", rep)
+	}
+	if addr := <-dialed; addr != "192.0.2.9:8080" {
+		t.Errorf("dialed %v,want the rewritten target", addr)
+	}
+	if data, err := ioutil.ReadAll(client); err != nil || string(data) != "rewritten" {
+		t.Errorf("relayed %q,%v", data, err)
+	}
+}
+
+func TestHookClose(t *testing.T) {
+	s := newTestServer(t)
+	pipeTarget(s, make(chan string, 1), "hello from the pipe", len("ping"))
+	type closed struct {
+		sent, received int64
+		session        *Session
+	}
+	done := make(chan closed, 1)
+	var connected *Session
+	s.AddHooks(&Hooks{
+		OnConnected: func(session *Session) {
+			connected = session
+		},
+		OnClose: func(session *Session, sent, received int64, duration time.Duration) {
+			done <- closed{sent, received, session}
+		},
+	})
+	client, rep := pipeCONNECT(t, s)
+	defer client.Close()
+	if rep != 0 {
+		t.Fatalf("reply %v", rep)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(client); err != nil || string(data) != "hello from the pipe" {
+		t.Errorf("relayed %q,%v", data, err)
+	}
+	select {
+	case c := <-done:
+		if c.sent != 4 || c.received != int64(len("hello from the pipe")) {
+			t.Errorf("OnClose got %v bytes sent,%v received", c.sent, c.received)
+		}
+		if c.session != connected || c.session.Command != CMD_CONNECT {
+			t.Errorf("OnClose got session %+v,OnConnected %+v", c.session, connected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose not called")
+	}
+}
@@ -0,0 +1,279 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyHash is compared against for unknown users,so their lookups take as
+// long as those of existing ones
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// HtpasswdAuth authenticates users against an htpasswd style file with one
+// user per line:
+//
+//	user:hash[:policy]
+//
+// hash is bcrypt ($2a$,$2b$,$2y$),argon2 ($argon2id$,$argon2i$),SHA-crypt
+// ($5$,$6$) or the unsalted {SHA} of htpasswd -s,which is only accepted for
+// existing files,plaintext passwords are not accepted.The optional policy is
+// in ParseUserPolicy syntax.Blank lines and # comments are skipped.
+type HtpasswdAuth struct {
+	path    string
+	locker  sync.RWMutex
+	users   map[string]string
+	policy  map[string]*UserPolicy
+	modTime time.Time
+	size    int64
+	stop    chan struct{}
+}
+
+// NewHtpasswdAuth loads the user file at path.
+func NewHtpasswdAuth(path string) (*HtpasswdAuth, error) {
+	h := &HtpasswdAuth{path: path}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the user file again,the old users stay in place if it is invalid.
+func (h *HtpasswdAuth) Reload() error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	users := make(map[string]string)
+	policy := make(map[string]*UserPolicy)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) < 2 || fields[0] == "" {
+			return fmt.Errorf("%v line %v: expected user:hash", h.path, n)
+		}
+		if err := checkHash(fields[1]); err != nil {
+			return fmt.Errorf("%v line %v: user %v: %v", h.path, n, fields[0], err)
+		}
+		users[fields[0]] = fields[1]
+		if len(fields) == 3 && fields[2] != "" {
+			p, err := ParseUserPolicy(fields[2])
+			if err != nil {
+				return fmt.Errorf("%v line %v: %v", h.path, n, err)
+			}
+			policy[fields[0]] = p
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	h.locker.Lock()
+	h.users, h.policy = users, policy
+	h.modTime, h.size = info.ModTime(), info.Size()
+	h.locker.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time or size changes,
+// checking every interval until Close is called.
+func (h *HtpasswdAuth) Watch(interval time.Duration) {
+	h.locker.Lock()
+	if h.stop != nil {
+		h.locker.Unlock()
+		return
+	}
+	h.stop = make(chan struct{})
+	stop := h.stop
+	h.locker.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			info, err := os.Stat(h.path)
+			if err != nil {
+				log.Printf("htpasswd %v: %v", h.path, err)
+				continue
+			}
+			h.locker.RLock()
+			changed := !info.ModTime().Equal(h.modTime) || info.Size() != h.size
+			h.locker.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := h.Reload(); err != nil {
+				log.Printf("htpasswd reload failed: %v", err)
+				continue
+			}
+			log.Printf("htpasswd %v reloaded", h.path)
+		}
+	}()
+}
+
+// Close stops watching the file.
+func (h *HtpasswdAuth) Close() {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// Authenticate checks the user's password,the identity carries the policy of
+// the user's line.
+func (h *HtpasswdAuth) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	if req.Method != AUTH_USERNAME_PASSWORD {
+		return nil, ERR_AUTH_FAILED
+	}
+	h.locker.RLock()
+	hashed, exists := h.users[req.Username]
+	policy := h.policy[req.Username]
+	h.locker.RUnlock()
+	if !exists {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(req.Password))
+		return nil, ERR_AUTH_FAILED
+	}
+	if !verifyHash(hashed, req.Password) {
+		return nil, ERR_AUTH_FAILED
+	}
+	return &Identity{User: req.Username, Policy: policy}, nil
+}
+
+// UserPolicy returns the policy given in the user's line,nil if there is none.
+func (h *HtpasswdAuth) UserPolicy(user string) *UserPolicy {
+	h.locker.RLock()
+	defer h.locker.RUnlock()
+	return h.policy[user]
+}
+
+// checkHash refuses hashes that verifyHash can't or shouldn't compute,so a
+// bad line fails at load and not at every login
+func checkHash(hashed string) error {
+	if strings.HasPrefix(hashed, "$argon2") {
+		_, err := parseArgon2(hashed)
+		return err
+	}
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "{SHA}"} {
+		if strings.HasPrefix(hashed, prefix) {
+			return nil
+		}
+	}
+	return errors.New("unsupported hash")
+}
+
+// verifyHash compares password with a supported hash in constant time
+func verifyHash(hashed, password string) bool {
+	switch {
+	case strings.HasPrefix(hashed, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case strings.HasPrefix(hashed, "$argon2"):
+		return verifyArgon2(hashed, password)
+	case strings.HasPrefix(hashed, "$5$"), strings.HasPrefix(hashed, "$6$"):
+		return verifySHACrypt(hashed, password)
+	case strings.HasPrefix(hashed, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hashed[5:])) == 1
+	}
+	return false
+}
+
+// argon2Hash is a parsed PHC formatted hash:$argon2id$v=19$m=65536,t=3,p=4$salt$hash
+type argon2Hash struct {
+	variant    string
+	memory     uint32
+	iterations uint32
+	threads    uint8
+	salt, key  []byte
+}
+
+// parseArgon2 parses an argon2 hash and checks its parameters,argon2 panics
+// on zero time or threads and allocates whatever memory it is told
+func parseArgon2(hashed string) (*argon2Hash, error) {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("argon2: expected $variant$v=$m=,t=,p=$salt$hash")
+	}
+	h := &argon2Hash{variant: parts[1]}
+	if h.variant != "argon2id" && h.variant != "argon2i" {
+		return nil, fmt.Errorf("argon2: unsupported variant %v", h.variant)
+	}
+	if parts[2] != "v="+strconv.Itoa(argon2.Version) {
+		return nil, fmt.Errorf("argon2: unsupported version %v", parts[2])
+	}
+	params := strings.Split(parts[3], ",")
+	if len(params) != 3 || !strings.HasPrefix(params[0], "m=") || !strings.HasPrefix(params[1], "t=") || !strings.HasPrefix(params[2], "p=") {
+		return nil, fmt.Errorf("argon2: bad parameters %v", parts[3])
+	}
+	memory, err := strconv.ParseUint(params[0][2:], 10, 32)
+	if err != nil || memory > ARGON2_MAX_MEMORY {
+		return nil, fmt.Errorf("argon2: memory must be at most %v KiB", ARGON2_MAX_MEMORY)
+	}
+	iterations, err := strconv.ParseUint(params[1][2:], 10, 32)
+	if err != nil || iterations < 1 || iterations > ARGON2_MAX_TIME {
+		return nil, fmt.Errorf("argon2: time must be 1-%v", ARGON2_MAX_TIME)
+	}
+	threads, err := strconv.ParseUint(params[2][2:], 10, 8)
+	if err != nil || threads < 1 || threads > ARGON2_MAX_THREADS {
+		return nil, fmt.Errorf("argon2: parallelism must be 1-%v", ARGON2_MAX_THREADS)
+	}
+	//argon2 needs 8 KiB per thread at least
+	if memory < 8*threads {
+		return nil, fmt.Errorf("argon2: memory must be at least %v KiB for p=%v", 8*threads, threads)
+	}
+	h.memory, h.iterations, h.threads = uint32(memory), uint32(iterations), uint8(threads)
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil || len(h.salt) < 8 {
+		return nil, errors.New("argon2: salt must be at least 8 bytes of base64")
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) < 16 || len(h.key) > 64 {
+		return nil, errors.New("argon2: hash must be 16-64 bytes of base64")
+	}
+	return h, nil
+}
+
+// verifyArgon2 checks password against an argon2 hash
+func verifyArgon2(hashed, password string) bool {
+	h, err := parseArgon2(hashed)
+	if err != nil {
+		return false
+	}
+	var got []byte
+	if h.variant == "argon2id" {
+		got = argon2.IDKey([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	} else {
+		got = argon2.Key([]byte(password), h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+	}
+	return subtle.ConstantTimeCompare(got, h.key) == 1
+}
@@ -0,0 +1,151 @@
+package socks5
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeUsersFile(t *testing.T, path string, lines ...string) {
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func htpasswdLogin(h *HtpasswdAuth, user, password string) (*Identity, error) {
+	return h.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: user, Password: password})
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := []byte("somesalt")
+	argon2Hash := "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(argon2.IDKey([]byte("secret"), salt, 1, 64, 1, 32))
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path,
+		"# users",
+		"",
+		"alice:"+string(bcryptHash)+":cmd=connect;max_sessions=2",
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"carol:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"dave:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"erin:"+argon2Hash,
+	)
+	h, err := NewHtpasswdAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		ok             bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", true},
+		{"bob", "Secret", false},
+		{"carol", "Hello world!", true},
+		{"carol", "hello world!", false},
+		{"dave", "Hello world!", true},
+		{"dave", "", false},
+		{"erin", "secret", true},
+		{"erin", "secreT", false},
+		{"mallory", "secret", false},
+	}
+	for _, tt := range tests {
+		identity, err := htpasswdLogin(h, tt.user, tt.password)
+		if tt.ok && (err != nil || identity.User != tt.user) {
+			t.Errorf("%v/%v refused: %v", tt.user, tt.password, err)
+		}
+		if !tt.ok && err != ERR_AUTH_FAILED {
+			t.Errorf("%v/%v: got %v,want ERR_AUTH_FAILED", tt.user, tt.password, err)
+		}
+	}
+	identity, _ := htpasswdLogin(h, "alice", "secret")
+	if identity.Policy == nil || identity.Policy.MaxSessions != 2 || h.UserPolicy("alice") != identity.Policy {
+		t.Errorf("policy of alice not loaded: %+v", identity.Policy)
+	}
+	if _, err := h.Authenticate(context.Background(), AuthRequest{Method: AUTH_NONE}); err != ERR_AUTH_FAILED {
+		t.Errorf("no auth accepted: %v", err)
+	}
+}
+
+func TestHtpasswdMalformed(t *testing.T) {
+	dir := t.TempDir()
+	for _, line := range []string{
+		"alice",
+		":$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"alice:secret",
+		"alice:$apr1$x$abcdefghijklmnopqrstuv",
+		"alice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=:cmd=bogus",
+		//argon2 parameters that would panic or exhaust memory at login
+		"alice:$argon2id$v=19$m=65536,t=3,p=0$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=4294967295,t=3,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=65536,t=4294967295,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=65536,t=3,p=256$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=16$m=65536,t=3,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=65536,t=3,p=4,x=1$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHQ$",
+		"alice:$argon2id$v=19$m=65536,t=3,p=4$$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+		"alice:$argon2d$v=19$m=65536,t=3,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG",
+	} {
+		path := filepath.Join(dir, "users")
+		writeUsersFile(t, path, "ok:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", line)
+		if _, err := NewHtpasswdAuth(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("line %q: got %v,want an error for line 2", line, err)
+		}
+	}
+	if _, err := NewHtpasswdAuth(filepath.Join(dir, "missing")); err == nil {
+		t.Error("a missing file must fail")
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	writeUsersFile(t, path, "bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=")
+	h, err := NewHtpasswdAuth(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	//an invalid file keeps the old users
+	writeUsersFile(t, path, "bob:plaintext")
+	if err := h.Reload(); err == nil {
+		t.Fatal("invalid file reloaded")
+	}
+	if _, err := htpasswdLogin(h, "bob", "secret"); err != nil {
+		t.Fatalf("old users lost: %v", err)
+	}
+
+	h.Watch(10 * time.Millisecond)
+	writeUsersFile(t, path, "carol:$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5")
+	//make sure the change is seen even on coarse modification times
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(path, future, future)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, err := htpasswdLogin(h, "carol", "Hello world!")
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("file change not picked up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := htpasswdLogin(h, "bob", "secret"); err != ERR_AUTH_FAILED {
+		t.Errorf("removed user still accepted: %v", err)
+	}
+}
@@ -0,0 +1,306 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPAuth authenticates users with an LDAP simple bind.The user's DN is either
+// built from UserDN or looked up below BaseDN with UserFilter,binding as BindDN
+// first.With GroupDN set the user must also be a member of that group.
+//
+// UserDN,UserFilter and GroupFilter may contain {user},GroupFilter also {dn},
+// both are escaped before they are substituted.
+type LDAPAuth struct {
+	// URL of the server,ldap://host:389 or ldaps://host:636
+	URL string
+	// StartTLS upgrades ldap:// connections before binding
+	StartTLS  bool
+	TLSConfig *tls.Config
+
+	// UserDN binds directly,e.g. "uid={user},ou=people,dc=example,dc=com"
+	UserDN string
+
+	// search then bind,used when UserDN is empty
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter defaults to "(uid={user})"
+	UserFilter string
+
+	// GroupDN is the group the user must belong to,empty admits all users
+	GroupDN string
+	// GroupFilter is matched against GroupDN,it defaults to
+	// "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+	GroupFilter string
+
+	// Timeout bounds dialing and every operation,LDAP_TIMEOUT if zero.A shorter
+	// deadline of the context passed to Authenticate wins.
+	Timeout time.Duration
+	// PoolSize is the number of idle connections kept,LDAP_POOL_SIZE if zero
+	PoolSize int
+
+	pool     chan *ldap.Conn
+	poolOnce sync.Once
+}
+
+// Authenticate binds as the user,the identity's "dn" attribute is the DN the
+// user bound with.
+func (a *LDAPAuth) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	//an empty password is an unauthenticated bind,which servers accept
+	if req.Method != AUTH_USERNAME_PASSWORD || req.Username == "" || req.Password == "" {
+		return nil, ERR_AUTH_FAILED
+	}
+	timeout, err := a.requestTimeout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ldap %v: %v", a.URL, err)
+	}
+	conn, pooled, err := a.get(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("ldap %v: %v", a.URL, err)
+	}
+	dn, err := a.verify(conn, req.Username, req.Password)
+	//the server may have dropped an idle connection,try once more on a new one
+	if err != nil && pooled && connectionFailed(err) {
+		conn.Close()
+		if conn, err = a.dial(timeout); err != nil {
+			return nil, fmt.Errorf("ldap %v: %v", a.URL, err)
+		}
+		dn, err = a.verify(conn, req.Username, req.Password)
+	}
+	a.put(conn, err)
+	if err != nil {
+		return nil, fmt.Errorf("ldap %v: %v", a.URL, err)
+	}
+	if dn == "" {
+		return nil, ERR_AUTH_FAILED
+	}
+	return &Identity{User: req.Username, Attributes: map[string]string{"dn": dn}}, nil
+}
+
+// verify binds as the user and checks the group membership,it returns the
+// user's DN or an empty one if the credentials are wrong
+func (a *LDAPAuth) verify(conn *ldap.Conn, user, pwd string) (string, error) {
+	var dn string
+	if a.UserDN != "" {
+		dn = strings.Replace(a.UserDN, "{user}", escapeDN(user), -1)
+	} else {
+		var err error
+		if dn, err = a.searchUser(conn, user); err != nil || dn == "" {
+			return "", err
+		}
+	}
+	if err := conn.Bind(dn, pwd); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return "", nil
+		}
+		return "", err
+	}
+	if a.GroupDN == "" {
+		return dn, nil
+	}
+	//group membership is read with the service account if there is one
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return "", err
+		}
+	}
+	filter := a.GroupFilter
+	if filter == "" {
+		filter = "(|(member={dn})(uniqueMember={dn})(memberUid={user}))"
+	}
+	filter = strings.NewReplacer("{dn}", ldap.EscapeFilter(dn), "{user}", ldap.EscapeFilter(user)).Replace(filter)
+	result, err := conn.Search(ldap.NewSearchRequest(a.GroupDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, a.timeoutSeconds(), false, filter, []string{"dn"}, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", nil
+		}
+		return "", err
+	}
+	if len(result.Entries) == 0 {
+		return "", nil
+	}
+	return dn, nil
+}
+
+// searchUser returns the DN of user,empty if there is no such user
+func (a *LDAPAuth) searchUser(conn *ldap.Conn, user string) (string, error) {
+	if a.BindDN != "" {
+		if err := conn.Bind(a.BindDN, a.BindPassword); err != nil {
+			return "", err
+		}
+	}
+	filter := a.UserFilter
+	if filter == "" {
+		filter = "(uid={user})"
+	}
+	filter = strings.Replace(filter, "{user}", ldap.EscapeFilter(user), -1)
+	result, err := conn.Search(ldap.NewSearchRequest(a.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, a.timeoutSeconds(), false, filter, []string{"dn"}, nil))
+	if err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return "", nil
+		}
+		return "", err
+	}
+	//an ambiguous filter must not let one user log in as another
+	if len(result.Entries) != 1 {
+		return "", nil
+	}
+	return result.Entries[0].DN, nil
+}
+
+// get takes an idle connection from the pool or dials a new one,its operations
+// are bounded by timeout
+func (a *LDAPAuth) get(timeout time.Duration) (conn *ldap.Conn, pooled bool, err error) {
+	a.initPool()
+	for {
+		select {
+		case conn = <-a.pool:
+		default:
+			conn, err = a.dial(timeout)
+			return conn, false, err
+		}
+		if !conn.IsClosing() {
+			conn.SetTimeout(timeout)
+			return conn, true, nil
+		}
+	}
+}
+
+func (a *LDAPAuth) dial(timeout time.Duration) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(a.URL, ldap.DialWithDialer(&net.Dialer{Timeout: timeout}),
+		ldap.DialWithTLSConfig(a.TLSConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(timeout)
+	if a.StartTLS {
+		if _, isTLS := conn.TLSConnectionState(); !isTLS {
+			config := a.TLSConfig
+			if config == nil {
+				config = &tls.Config{}
+				if u, err := url.Parse(a.URL); err == nil {
+					config.ServerName = u.Hostname()
+				}
+			}
+			if err := conn.StartTLS(config); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+	}
+	return conn, nil
+}
+
+// put returns conn to the pool unless it failed at the connection level or the
+// pool is full.It is bound as the service account again first,or anonymously
+// without one,so an idle connection doesn't keep the rights of the last user.
+func (a *LDAPAuth) put(conn *ldap.Conn, err error) {
+	if err != nil && connectionFailed(err) {
+		conn.Close()
+		return
+	}
+	if a.BindDN != "" {
+		err = conn.Bind(a.BindDN, a.BindPassword)
+	} else {
+		err = conn.UnauthenticatedBind("")
+	}
+	if err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case a.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// connectionFailed tells errors of the connection from LDAP result codes
+func connectionFailed(err error) bool {
+	var ldapErr *ldap.Error
+	return !errors.As(err, &ldapErr) || ldapErr.ResultCode >= ldap.ErrorNetwork
+}
+
+// Close closes the pooled connections.
+func (a *LDAPAuth) Close() {
+	a.initPool()
+	for {
+		select {
+		case conn := <-a.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+func (a *LDAPAuth) initPool() {
+	a.poolOnce.Do(func() {
+		size := a.PoolSize
+		if size <= 0 {
+			size = LDAP_POOL_SIZE
+		}
+		a.pool = make(chan *ldap.Conn, size)
+	})
+}
+
+func (a *LDAPAuth) timeout() time.Duration {
+	if a.Timeout > 0 {
+		return a.Timeout
+	}
+	return LDAP_TIMEOUT
+}
+
+// requestTimeout bounds the dial and the operations of a request,by Timeout
+// and the deadline of ctx
+func (a *LDAPAuth) requestTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	timeout := a.timeout()
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < timeout {
+			if left <= 0 {
+				return 0, context.DeadlineExceeded
+			}
+			timeout = left
+		}
+	}
+	return timeout, nil
+}
+
+func (a *LDAPAuth) timeoutSeconds() int {
+	return int((a.timeout() + time.Second - 1) / time.Second)
+}
+
+// escapeDN escapes an attribute value for use in a DN,RFC 4514
+func escapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,338 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	ldapAliceDN = "uid=alice,ou=people,dc=example,dc=com"
+	ldapBobDN   = "uid=bob,ou=people,dc=example,dc=com"
+	ldapSvcDN   = "cn=svc,dc=example,dc=com"
+	ldapGroupDN = "cn=proxy,ou=groups,dc=example,dc=com"
+)
+
+// ldapStub is an in-process LDAP server knowing alice and bob,of whom only
+// alice is in ldapGroupDN,and the service account ldapSvcDN.Anonymous binds
+// are allowed.
+type ldapStub struct {
+	listener net.Listener
+	accepted int32
+
+	locker  sync.Mutex
+	conns   []net.Conn
+	filters []*ber.Packet
+	//binds holds the DNs of the successful binds in order
+	binds []string
+}
+
+func newLDAPStub(t *testing.T) *ldapStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &ldapStub{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&stub.accepted, 1)
+			stub.locker.Lock()
+			stub.conns = append(stub.conns, conn)
+			stub.locker.Unlock()
+			go stub.serve(conn)
+		}
+	}()
+	return stub
+}
+
+func (s *ldapStub) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapStub) Close() {
+	s.listener.Close()
+	s.dropConns()
+}
+
+// dropConns closes every connection,like a server timing out idle clients
+func (s *ldapStub) dropConns() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn, pwd := op.Children[1].Value.(string), string(op.Children[2].Data.Bytes())
+			code := ldap.LDAPResultInvalidCredentials
+			if (dn == ldapAliceDN || dn == ldapBobDN) && pwd == "secret" || dn == ldapSvcDN && pwd == "svcpw" || dn == "" && pwd == "" {
+				code = ldap.LDAPResultSuccess
+				s.locker.Lock()
+				s.binds = append(s.binds, dn)
+				s.locker.Unlock()
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationBindResponse, code).Bytes())
+		case ldap.ApplicationSearchRequest:
+			base, filter := op.Children[0].Value.(string), op.Children[6]
+			s.locker.Lock()
+			s.filters = append(s.filters, filter)
+			s.locker.Unlock()
+			for _, dn := range ldapSearch(base, filter) {
+				conn.Write(ldapEntry(id, dn).Bytes())
+			}
+			conn.Write(ldapResponse(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+		default:
+			return
+		}
+	}
+}
+
+// ldapSearch returns the DNs below base matching filter
+func ldapSearch(base string, filter *ber.Packet) []string {
+	values := ldapEqualityValues(filter)
+	switch base {
+	case "ou=people,dc=example,dc=com":
+		var dns []string
+		for _, v := range values {
+			switch v {
+			case "alice":
+				dns = append(dns, ldapAliceDN)
+			case "bob":
+				dns = append(dns, ldapBobDN)
+			case "twin":
+				dns = append(dns, ldapAliceDN, ldapBobDN)
+			}
+		}
+		return dns
+	case ldapGroupDN:
+		for _, v := range values {
+			if v == ldapAliceDN {
+				return []string{ldapGroupDN}
+			}
+		}
+	}
+	return nil
+}
+
+// ldapEqualityValues collects the values of the equality matches in filter
+func ldapEqualityValues(filter *ber.Packet) []string {
+	if filter.ClassType == ber.ClassContext && filter.Tag == ldap.FilterEqualityMatch {
+		return []string{string(filter.Children[1].Data.Bytes())}
+	}
+	var values []string
+	if filter.Tag == ldap.FilterAnd || filter.Tag == ldap.FilterOr {
+		for _, child := range filter.Children {
+			values = append(values, ldapEqualityValues(child)...)
+		}
+	}
+	return values
+}
+
+func ldapMessage(id int64, op *ber.Packet) *ber.Packet {
+	msg := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	msg.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	msg.AppendChild(op)
+	return msg
+}
+
+func ldapResponse(id int64, app ber.Tag, code int) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, app, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	return ldapMessage(id, op)
+}
+
+func ldapEntry(id int64, dn string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	op.AppendChild(ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, ""))
+	return ldapMessage(id, op)
+}
+
+func ldapLogin(a *LDAPAuth, user, password string) (*Identity, error) {
+	return a.Authenticate(context.Background(), AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: user, Password: password})
+}
+
+func TestLDAPAuth(t *testing.T) {
+	stub := newLDAPStub(t)
+	defer stub.Close()
+	template := &LDAPAuth{URL: stub.URL(), UserDN: "uid={user},ou=people,dc=example,dc=com"}
+	search := &LDAPAuth{URL: stub.URL(), BindDN: ldapSvcDN, BindPassword: "svcpw", BaseDN: "ou=people,dc=example,dc=com"}
+	group := &LDAPAuth{URL: stub.URL(), BindDN: ldapSvcDN, BindPassword: "svcpw", BaseDN: "ou=people,dc=example,dc=com", GroupDN: ldapGroupDN}
+	badService := &LDAPAuth{URL: stub.URL(), BindDN: ldapSvcDN, BindPassword: "wrong", BaseDN: "ou=people,dc=example,dc=com"}
+	defer template.Close()
+	defer search.Close()
+	defer group.Close()
+	defer badService.Close()
+
+	tests := []struct {
+		name           string
+		auth           *LDAPAuth
+		user, password string
+		dn             string
+		authErr        bool
+	}{
+		{"template", template, "alice", "secret", ldapAliceDN, false},
+		{"template bind failure", template, "alice", "wrong", "", true},
+		{"template escapes the DN", template, "alice,ou=people", "secret", "", true},
+		{"search", search, "bob", "secret", ldapBobDN, false},
+		{"search bind failure", search, "bob", "wrong", "", true},
+		{"unknown user", search, "carol", "secret", "", true},
+		{"ambiguous filter", search, "twin", "secret", "", true},
+		{"empty password", search, "alice", "", "", true},
+		{"group member", group, "alice", "secret", ldapAliceDN, false},
+		{"not a group member", group, "bob", "secret", "", true},
+		{"service account bind failure", badService, "alice", "secret", "", false},
+	}
+	for _, tt := range tests {
+		identity, err := ldapLogin(tt.auth, tt.user, tt.password)
+		switch {
+		case tt.dn != "":
+			if err != nil || identity.User != tt.user || identity.Attributes["dn"] != tt.dn {
+				t.Errorf("%v: got %+v,%v", tt.name, identity, err)
+			}
+		case tt.authErr:
+			if err != ERR_AUTH_FAILED {
+				t.Errorf("%v: got %v,want ERR_AUTH_FAILED", tt.name, err)
+			}
+		default:
+			if err == nil || err == ERR_AUTH_FAILED {
+				t.Errorf("%v: got %v,want an error of the server", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestLDAPAuthFilterEscaping(t *testing.T) {
+	stub := newLDAPStub(t)
+	defer stub.Close()
+	a := &LDAPAuth{URL: stub.URL(), BindDN: ldapSvcDN, BindPassword: "svcpw", BaseDN: "ou=people,dc=example,dc=com"}
+	defer a.Close()
+	for _, user := range []string{"*", "alice)(uid=*", `a*()\` + "\x00", "bob\x00"} {
+		if _, err := ldapLogin(a, user, "secret"); err != ERR_AUTH_FAILED {
+			t.Errorf("user %q: got %v,want ERR_AUTH_FAILED", user, err)
+		}
+		stub.locker.Lock()
+		filter := stub.filters[len(stub.filters)-1]
+		stub.locker.Unlock()
+		//escaped,the whole name arrives as the value of one equality match
+		if filter.ClassType != ber.ClassContext || filter.Tag != ldap.FilterEqualityMatch {
+			t.Errorf("user %q: filter %v is not an equality match", user, ldap.FilterMap[uint64(filter.Tag)])
+			continue
+		}
+		if attr, value := filter.Children[0].Value.(string), string(filter.Children[1].Data.Bytes()); attr != "uid" || value != user {
+			t.Errorf("user %q: filter compares %v with %q", user, attr, value)
+		}
+	}
+}
+
+func TestLDAPAuthPool(t *testing.T) {
+	stub := newLDAPStub(t)
+	defer stub.Close()
+	a := &LDAPAuth{URL: stub.URL(), UserDN: "uid={user},ou=people,dc=example,dc=com", PoolSize: 1}
+	defer a.Close()
+	for i := 0; i < 5; i++ {
+		if _, err := ldapLogin(a, "alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+		ldapLogin(a, "alice", "wrong")
+	}
+	if n := atomic.LoadInt32(&stub.accepted); n != 1 {
+		t.Errorf("pooled connection not reused,%v connections", n)
+	}
+	//a connection the server dropped is replaced
+	stub.dropConns()
+	if _, err := ldapLogin(a, "alice", "secret"); err != nil {
+		t.Fatalf("login after the server dropped the connection: %v", err)
+	}
+	if n := atomic.LoadInt32(&stub.accepted); n != 2 {
+		t.Errorf("%v connections,want 2", n)
+	}
+}
+
+// TestLDAPAuthRebind checks a pooled connection no longer has the rights of the
+// user who logged in last
+func TestLDAPAuthRebind(t *testing.T) {
+	stub := newLDAPStub(t)
+	defer stub.Close()
+	template := &LDAPAuth{URL: stub.URL(), UserDN: "uid={user},ou=people,dc=example,dc=com", PoolSize: 1}
+	defer template.Close()
+	search := &LDAPAuth{URL: stub.URL(), BindDN: ldapSvcDN, BindPassword: "svcpw", BaseDN: "ou=people,dc=example,dc=com", PoolSize: 1}
+	defer search.Close()
+	tests := []struct {
+		name string
+		a    *LDAPAuth
+		want string
+	}{
+		{"anonymous", template, ""},
+		{"service account", search, ldapSvcDN},
+	}
+	for _, tt := range tests {
+		if _, err := ldapLogin(tt.a, "alice", "secret"); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		stub.locker.Lock()
+		last := stub.binds[len(stub.binds)-1]
+		stub.locker.Unlock()
+		if last != tt.want {
+			t.Errorf("%v: pooled connection bound as %q,want %q", tt.name, last, tt.want)
+		}
+	}
+}
+
+func TestLDAPAuthContext(t *testing.T) {
+	//a server that accepts but never answers
+	listener := listenTest(t)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	a := &LDAPAuth{URL: "ldap://" + listener.Addr().String(), UserDN: "uid={user},ou=people,dc=example,dc=com", Timeout: time.Minute}
+	defer a.Close()
+	req := AuthRequest{Method: AUTH_USERNAME_PASSWORD, Username: "alice", Password: "secret"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := a.Authenticate(ctx, req); err == nil || err == ERR_AUTH_FAILED {
+		t.Errorf("got %v,want a backend error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("failed after %v,the deadline of the context wasn't applied", elapsed)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.Authenticate(ctx, req); err == nil || err == ERR_AUTH_FAILED {
+		t.Errorf("canceled context: got %v,want a backend error", err)
+	}
+}
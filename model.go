@@ -2,12 +2,12 @@ package socks5
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -15,10 +15,70 @@ import (
 type Server struct {
 	*Socks5UDPserver
 	//conn          []*TCPConn
-	locker        sync.RWMutex
-	TCPRequestMap map[string]*TCPRequest
-	hostResolver  *net.Resolver
-	Conf          Config
+	locker       sync.RWMutex
+	Sessions     *SessionRegistry
+	hostResolver *net.Resolver
+	Conf         Config
+
+	// HandshakeTimeout bounds the time a client may take from connecting until
+	// its request (greeting, authentication and command) has been read.
+	HandshakeTimeout time.Duration
+	// ConnectTimeout bounds dialing the destination of a CONNECT request.
+	ConnectTimeout time.Duration
+	// ClientIdleTimeout closes a CONNECT/BIND session once the client has sent
+	// nothing for that long, TargetIdleTimeout does the same for the target.
+	// Zero disables the respective check, which also lets that direction be
+	// relayed without copying through userspace.
+	ClientIdleTimeout time.Duration
+	TargetIdleTimeout time.Duration
+	// BindTimeout bounds the wait for the inbound connection of a BIND request.
+	BindTimeout time.Duration
+	// BindAllowAnyPeer accepts the BIND connection from any address instead of
+	// only from the DST.ADDR given in the request.
+	BindAllowAnyPeer bool
+	// Rules restricts the destinations clients may reach,nil allows all.
+	Rules *RuleSet
+	// ClientACL restricts which client addresses may use the proxy,TCP and UDP.
+	ClientACL *ClientACL
+	// Egress refuses internal destinations (SSRF protection),it is on by
+	// default,set it to nil or Disabled to reach private networks.
+	Egress *EgressGuard
+	// Upstream sends CONNECT and UDP ASSOCIATE traffic through other proxies
+	// instead of dialing destinations directly,nil dials directly.Clients
+	// don't notice.Host names of CONNECT requests are resolved by the last
+	// hop unless Upstream.LocalDNS is set or a Router needs their addresses,
+	// the egress guard only checks destinations it knows the address of.
+	Upstream *ProxyChain
+	// Source is where outgoing connections leave the host unless the user's
+	// policy or the outbound sets one,nil lets the system choose.
+	Source *EgressSource
+	// Router sends CONNECT requests and UDP datagrams to the outbound its
+	// routes pick,nil leaves all of them to Upstream or a direct connection.
+	Router *Router
+	// Rewriter sends requests for some destinations to others,nil leaves
+	// them alone.The egress guard lets through the hosts it picks,but not
+	// the proxy's own listeners.
+	Rewriter *Rewriter
+	// Dialer connects to destinations,and to the first proxy of Upstream and
+	// proxy outbounds,in place of a net.Dialer,e.g. for custom egress or an
+	// in-memory network in tests.The context carries the client request,see
+	// RequestFromContext.Destinations are still checked by the egress guard,
+	// which resolves host names and passes on the addresses it checked.
+	// Source is left to the dialer.
+	Dialer Dialer
+	// PacketDialer is Dialer for the sockets relaying UDP datagrams.
+	PacketDialer PacketDialer
+	// AuthThrottle bans clients and users after repeated failed logins,it is
+	// on by default,nil disables it.Errors of the user backend aren't counted,
+	// only refused credentials.
+	AuthThrottle *AuthThrottle
+	// BandwidthClasses maps the UserPolicy.Bandwidth names to bytes per second,
+	// shared by all sessions of a user and applied to each direction.Limited
+	// sessions are relayed through userspace instead of with zero-copy.
+	BandwidthClasses map[string]int64
+	limiters         map[string]*userLimiters
+	//registered with AddHooks
+	hooks []*Hooks
 }
 
 var DNSAddrs = []string{
@@ -31,11 +91,18 @@ var DNSAddrs = []string{
 // new socks5 proxy server and start UDP listening,include multiple DNS server for resolve host ip
 func NewSocks5Server(config Config) *Server {
 	log.SetFlags(log.Lshortfile | log.LstdFlags)
-	s := &Server{}
+	s := &Server{
+		Conf:             config,
+		HandshakeTimeout: HANDSHAKE_TIMEOUT,
+		ConnectTimeout:   CONNECT_TIMEOUT,
+		BindTimeout:      BIND_TIMEOUT,
+		Egress:           NewEgressGuard(),
+		AuthThrottle:     NewAuthThrottle(),
+	}
 	if config == nil {
 		s.Conf = DefaultConfig
 	}
-	s.TCPRequestMap = make(map[string]*TCPRequest)
+	s.Sessions = newSessionRegistry()
 	s.locker = sync.RWMutex{}
 	s.hostResolver = &net.Resolver{
 		PreferGo: false,
@@ -53,7 +120,8 @@ func NewSocks5Server(config Config) *Server {
 			return nil, nil
 		},
 	}
-	//UDP SERVER
+	//UDP SERVER,set up before any listener or forward can use its maps
+	s.Socks5UDPserver = s.newUDPServer()
 	go s.startUDPServer()
 	return s
 }
@@ -65,22 +133,49 @@ func (s *Server) Listen() error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(listener, nil)
+}
+
+// ListenTLS is Listen with TLS,see ListenerOptions.TLS.
+func (s *Server) ListenTLS(config *tls.Config) error {
+	listener, err := net.Listen("tcp", ":"+s.Conf.GetPort())
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener, &ListenerOptions{TLS: config})
+}
+
+// Serve accepts SOCKS connections on listener until it fails,opts may be nil.
+// Clients refused by the ACLs are disconnected before anything is read.
+func (s *Server) Serve(listener net.Listener, opts *ListenerOptions) error {
+	s.Egress.addListener(listener.Addr())
+	if opts != nil && opts.TLS != nil {
+		listener = tls.NewListener(listener, opts.TLS)
+	}
 	log.Printf("TCP SERVER IS LISTENING ON %v", listener.Addr())
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		if !s.permitClient(conn.RemoteAddr(), opts) {
+			log.Printf("CLIENT %v REFUSED BY ACL\n", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 		tConn := &TCPConn{
-			server:  s,
-			tcpConn: conn.(*net.TCPConn),
+			server: s,
+			id:     s.Sessions.NewID(),
+			conn:   conn,
+			opts:   opts,
 		}
 		//s.conn = append(s.conn, tConn)
 		go tConn.ServConn(conn)
 	}
 }
 
-func (s *Server) startUDPServer() {
+// newUDPServer opens the UDP relay on the server port
+func (s *Server) newUDPServer() *Socks5UDPserver {
 	expectedAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%v:%v", "0.0.0.0", s.Conf.GetPort()))
 	if err != nil {
 		panic(err)
@@ -90,10 +185,17 @@ func (s *Server) startUDPServer() {
 	if err != nil {
 		panic(err)
 	}
-	s.Socks5UDPserver = &Socks5UDPserver{
+	s.Egress.addListener(relayConn.LocalAddr())
+	return &Socks5UDPserver{
 		udpConn:       relayConn,
 		UDPRequestMap: make(map[string]*UDPRequest),
+		udpClients:    make(map[string]*Session),
 	}
+}
+
+// startUDPServer relays the datagrams of UDP ASSOCIATE clients
+func (s *Server) startUDPServer() {
+	relayConn := s.udpConn
 	defer relayConn.Close()
 	log.Printf("UDP SERVER IS LISTENING ON %v", relayConn.LocalAddr())
 	for {
@@ -109,82 +211,235 @@ func (s *Server) startUDPServer() {
 				continue
 			}
 		}
+		if !s.ClientACL.Permit(clientAddr.IP) {
+			continue
+		}
 		go s.UDPTransport(relayConn, clientAddr, b[:n])
 	}
 }
 
 type TCPConn struct {
-	server  *Server
-	id      string
-	tcpConn *net.TCPConn
+	server *Server
+	id     uint64
+	user   string
+	policy *UserPolicy
+	//set once the client has authenticated
+	identity *Identity
+	//identity of a verified TLS client certificate
+	certIdentity *Identity
+	opts         *ListenerOptions
+	conn         net.Conn
+	//the request being served,nil during the handshake
+	request *TCPRequest
 	Dialer  *net.Dialer
 }
 
-// RegisterTCPRequest Add new connect request
-func (s *TCPConn) RegisterTCPRequest(req *TCPRequest) *TCPRequest {
-	s.server.locker.Lock()
-	defer s.server.locker.Unlock()
-	targetAddrStr := req.TargetConn.RemoteAddr().(*net.TCPAddr).String()
-	if s.server.TCPRequestMap[targetAddrStr] == nil {
-		s.server.TCPRequestMap[targetAddrStr] = req
+func (s *TCPConn) DialTCP(addr *net.TCPAddr) (net.Conn, error) {
+	return s.DialHost(addr.String())
+}
+
+// DialHost dials host:port,a host name is resolved and every address is tried
+// in turn (Happy Eyeballs),each one checked by the server's egress guard.
+// With Server.Upstream the name is passed on to the proxy chain instead,
+// Server.Dialer is used unless the connection has a Dialer of its own.
+func (s *TCPConn) DialHost(hostport string) (net.Conn, error) {
+	if chain := s.server.Upstream; chain != nil {
+		return s.dialUpstream(chain, nil, hostport)
+	}
+	if s.Dialer == nil && s.server.Dialer != nil {
+		return s.dialCustom(nil, hostport)
 	}
-	return s.server.TCPRequestMap[targetAddrStr]
+	if s.Dialer == nil {
+		d, err := s.directDialer(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		s.Dialer = d
+	}
+	return s.Dialer.Dial("tcp", hostport)
 }
 
-// DelTCPRequest del request & close connection
-func (s *TCPConn) DelTCPRequest(targetAddr string) {
-	s.server.locker.Lock()
-	defer s.server.locker.Unlock()
-	request := s.server.TCPRequestMap[targetAddr]
-	if request != nil {
-		if request.TargetConn != nil {
-			request.TargetConn.Close()
+// dialRequest describes the current request for dialers,out is the outbound
+// it is dialed through
+func (s *TCPConn) dialRequest(out *Outbound) *DialRequest {
+	req := &DialRequest{User: s.user, Identity: s.identity, Outbound: out}
+	if s.conn != nil {
+		req.Client = s.conn.RemoteAddr()
+	}
+	if s.request != nil {
+		req.Command, req.Domain = s.request.cmd, s.request.domain
+	}
+	return req
+}
+
+// dialCustom connects to hostport with Server.Dialer once the egress guard
+// has checked it.The dialer gets the checked addresses of a host name one by
+// one,the name is in the DialRequest.
+func (s *TCPConn) dialCustom(out *Outbound, hostport string) (net.Conn, error) {
+	ctx, cancel := s.server.dialContext(s.dialRequest(out))
+	defer cancel()
+	addrs, err := s.egress().resolveHost(ctx, hostport)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, addr := range addrs {
+		conn, err := s.server.Dialer.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
 		}
 	}
-	delete(s.server.TCPRequestMap, targetAddr)
+	return nil, firstErr
+}
 
+// egress returns the guard checking the destination of the current request
+func (s *TCPConn) egress() *EgressGuard {
+	if s.request != nil && s.request.rewritten {
+		return s.server.Egress.rewritten()
+	}
+	return s.server.Egress
 }
-func (s *TCPConn) DialTCP(addr *net.TCPAddr) (net.Conn, error) {
-	if s.Dialer == nil {
-		s.Dialer = DEFAULT_TCP_DIALER
+
+// egressSource returns the source for connections through out,which may be
+// nil:the outbound's,the user's or the server's
+func (s *TCPConn) egressSource(out *Outbound) *EgressSource {
+	if source := out.source(); source != nil {
+		return source
+	}
+	if source := s.policy.egressSource(); source != nil {
+		return source
+	}
+	return s.server.Source
+}
+
+// listenerIP is the local address the client connected to
+func (s *TCPConn) listenerIP() net.IP {
+	if s.conn == nil {
+		return nil
+	}
+	ip, _ := addrIPPort(s.conn.LocalAddr())
+	return ip
+}
+
+// directDialer returns a dialer for destinations checked by the egress guard,
+// leaving the host where out says,target is the destination address if known
+func (s *TCPConn) directDialer(out *Outbound, target net.IP) (*net.Dialer, error) {
+	d := s.server.tcpDialer(nil)
+	if guard := s.egress(); guard != nil {
+		d.Control = chainControl(guard.control, d.Control)
+	}
+	if err := s.egressSource(out).apply(&d, "tcp", s.listenerIP(), target); err != nil {
+		return nil, err
 	}
-	return s.Dialer.Dial("tcp", addr.String())
+	return &d, nil
 }
 
+// dialUpstream connects to hostport through chain,the proxies themselves are
+// not subject to the egress guard,nor are names without ProxyChain.LocalDNS.
+// The first hop is dialed from the source of out,or by Server.Dialer.
+func (s *TCPConn) dialUpstream(chain *ProxyChain, out *Outbound, hostport string) (net.Conn, error) {
+	ctx, cancel := s.server.dialContext(s.dialRequest(out))
+	defer cancel()
+	if err := s.egress().checkHost(ctx, hostport, chain.LocalDNS); err != nil {
+		return nil, err
+	}
+	if s.server.Dialer != nil {
+		return chain.dial(ctx, s.server.Dialer, "tcp", hostport)
+	}
+	d := s.server.tcpDialer(chain.Dialer)
+	if err := s.egressSource(out).apply(&d, "tcp", s.listenerIP(), nil); err != nil {
+		return nil, err
+	}
+	return chain.dial(ctx, &d, "tcp", hostport)
+}
+
+// tcpDialer returns a copy of d,DEFAULT_TCP_DIALER if nil,whose Timeout is
+// Server.ConnectTimeout if that is set
+func (s *Server) tcpDialer(d *net.Dialer) net.Dialer {
+	if d == nil {
+		d = DEFAULT_TCP_DIALER
+	}
+	copied := *d
+	if s.ConnectTimeout > 0 {
+		copied.Timeout = s.ConnectTimeout
+	}
+	return copied
+}
+
+// remoteDNS reports whether host names of CONNECT requests go to Upstream
+// unresolved
+func (s *Server) remoteDNS() bool {
+	return s.Upstream != nil && !s.Upstream.LocalDNS && s.Router == nil
+}
+
+// DEFAULT_TCP_DIALER is the template for outgoing connections,it is copied
+// and its Timeout is overridden by Server.ConnectTimeout when that is set.
 var DEFAULT_TCP_DIALER = &net.Dialer{
 	Timeout: time.Second * 3,
 }
 
+// ID returns the session ID of the connection,unique within the process.
 func (s *TCPConn) ID() string {
-	if s.id == "" {
-		m := md5.New()
-		m.Write([]byte(s.tcpConn.RemoteAddr().String()))
-		s.id = hex.EncodeToString(m.Sum(nil))[:5]
+	if s.id == 0 {
+		s.id = s.server.Sessions.NewID()
 	}
-	return s.id
+	return strconv.FormatUint(s.id, 10)
 }
 
 type Socks5UDPserver struct {
 	server        *Server
 	udpConn       *net.UDPConn
 	UDPRequestMap map[string]*UDPRequest
+	//client address -> UDP ASSOCIATE session
+	udpClients map[string]*Session
 }
 
 // UDPRequest save each of udp conn by client.support for fragments
 type UDPRequest struct {
-	clientAddr       *net.UDPAddr
-	remoteConn       *net.UDPConn
-	remoteAddr       *net.UDPAddr
+	clientAddr *net.UDPAddr
+	remoteConn net.Conn
+	remoteAddr *net.UDPAddr
+	//where the client sent the datagrams,replies carry it in their header
+	replyAddr   *net.UDPAddr
+	replyDomain string
+	//port forward,no SOCKS5 header on replies
+	raw bool
+	//control connection of the association with Server.Upstream,nil when
+	//remoteConn goes straight to remoteAddr
+	upstream         net.Conn
 	reassemblyQueue  []byte
 	position         int
 	requestConn      net.Conn
 	lastFragmentTime time.Time
+	key              string
+	session          *Session
+	user             string
+	policy           *UserPolicy
 }
 type TCPRequest struct {
 	TargetAddr *net.TCPAddr
+	//requested domain name and all of its addresses,empty for address requests
+	domain     string
+	targetIPs  []net.IP
 	clientAddr *net.TCPAddr
 	//clientConn net.Conn
 	TargetConn net.Conn
-	atyp       int
-	cmd        int
+	//authenticated user and its policy,empty/nil without authentication
+	user   string
+	policy *UserPolicy
+	atyp   int
+	cmd    int
+	//the host was picked by Server.Rewriter,see EgressGuard.rewritten
+	rewritten bool
+}
+
+// hostport is the requested destination,with the host name if the client sent one
+func (r *TCPRequest) hostport() string {
+	if r.domain != "" {
+		return net.JoinHostPort(r.domain, strconv.Itoa(r.TargetAddr.Port))
+	}
+	return r.TargetAddr.String()
 }
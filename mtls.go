@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"strings"
+)
+
+// CertSubjectIdentity is the default ListenerOptions.CertIdentity.The user is
+// the subject's common name,or the first DNS name,email address or URI of the
+// certificate if there is none.The attributes hold the subject,the SANs and
+// the serial number.
+func CertSubjectIdentity(cert *x509.Certificate) (*Identity, error) {
+	attrs := map[string]string{
+		"subject": cert.Subject.String(),
+		"serial":  cert.SerialNumber.String(),
+	}
+	var uris []string
+	for _, u := range cert.URIs {
+		uris = append(uris, u.String())
+	}
+	if len(cert.DNSNames) > 0 {
+		attrs["dns"] = strings.Join(cert.DNSNames, ",")
+	}
+	if len(cert.EmailAddresses) > 0 {
+		attrs["email"] = strings.Join(cert.EmailAddresses, ",")
+	}
+	if len(uris) > 0 {
+		attrs["uri"] = strings.Join(uris, ",")
+	}
+	user := cert.Subject.CommonName
+	for _, names := range [][]string{cert.DNSNames, cert.EmailAddresses, uris} {
+		if user == "" && len(names) > 0 {
+			user = names[0]
+		}
+	}
+	if user == "" {
+		return nil, errors.New("client certificate names no user")
+	}
+	return &Identity{User: user, Attributes: attrs}, nil
+}
+
+// tlsHandshake completes the handshake of a TLS listener and maps a verified
+// client certificate to the identity of the connection
+func (s *TCPConn) tlsHandshake(conn *tls.Conn) error {
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	return s.verifiedPeer(conn.ConnectionState())
+}
+
+// verifiedPeer maps the verified client certificate of a TLS connection,if
+// any,to the identity of the connection
+func (s *TCPConn) verifiedPeer(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	mapIdentity := CertSubjectIdentity
+	if s.opts != nil && s.opts.CertIdentity != nil {
+		mapIdentity = s.opts.CertIdentity
+	}
+	identity, err := mapIdentity(state.PeerCertificates[0])
+	if err != nil {
+		return err
+	}
+	if identity == nil {
+		return ERR_AUTH_FAILED
+	}
+	//certificate users get the policy a user of the same name has
+	if identity.Policy == nil && identity.User != "" {
+		if provider, ok := s.server.Conf.(PolicyProvider); ok {
+			identity.Policy = provider.UserPolicy(identity.User)
+		}
+	}
+	s.certIdentity = identity
+	return nil
+}
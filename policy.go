@@ -0,0 +1,221 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UserPolicy restricts what an authenticated user may do.
+type UserPolicy struct {
+	// Commands the user may issue,empty allows all
+	Commands []int
+	// Rules are evaluated before Server.Rules,the first match decides,
+	// requests none of them match are left to Server.Rules
+	Rules []*Rule
+	// MaxSessions limits the concurrent sessions of the user,0 is unlimited
+	MaxSessions int
+	// Bandwidth names an entry of Server.BandwidthClasses
+	Bandwidth string
+	// EgressIP is the source address of the user's outgoing traffic
+	EgressIP net.IP
+	// EgressInterface is the network interface of the user's outgoing
+	// traffic,see EgressSource
+	EgressInterface string
+	// EgressMatchListener uses the address of the listener the user
+	// connected to as the source,see EgressSource
+	EgressMatchListener bool
+}
+
+// PolicyProvider is implemented by credential sources that also hold per-user
+// policies.The server asks the Config for it once a user has authenticated.
+type PolicyProvider interface {
+	UserPolicy(user string) *UserPolicy
+}
+
+// egressSource returns the user's source settings,nil if there are none
+func (p *UserPolicy) egressSource() *EgressSource {
+	if p == nil || (p.EgressIP == nil && p.EgressInterface == "" && !p.EgressMatchListener) {
+		return nil
+	}
+	return &EgressSource{IP: p.EgressIP, Interface: p.EgressInterface, MatchListener: p.EgressMatchListener}
+}
+
+// allowCommand reports whether the policy permits cmd,a nil policy permits all
+func (p *UserPolicy) allowCommand(cmd int) bool {
+	return p == nil || len(p.Commands) == 0 || containsInt(p.Commands, cmd)
+}
+
+// evaluate runs the user's rules and then the server rules
+func (p *UserPolicy) evaluate(rs *RuleSet, req *RuleRequest) bool {
+	if p != nil {
+		for _, r := range p.Rules {
+			if r.Match(req) {
+				return r.Action == RuleAllow
+			}
+		}
+	}
+	return rs.Allow(req)
+}
+
+// ParseUserPolicy parses a policy written as ";" separated key=value pairs:
+//
+//	cmd=connect,udp;max_sessions=4;bandwidth=basic;egress_ip=192.0.2.10;deny=dst=10.0.0.0/8 port=22;allow=domain=*.corp
+//
+// egress_ip=listener selects EgressMatchListener,egress_interface sets EgressInterface.
+// allow and deny may be repeated,each adds a rule in ParseRule syntax,in order.
+func ParseUserPolicy(text string) (*UserPolicy, error) {
+	p := &UserPolicy{}
+	for _, attr := range strings.Split(text, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		kv := strings.SplitN(attr, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid policy attribute %q", attr)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		switch key {
+		case "cmd":
+			for _, v := range strings.Split(value, ",") {
+				cmd, err := parseCommand(v)
+				if err != nil {
+					return nil, err
+				}
+				p.Commands = append(p.Commands, cmd)
+			}
+		case "max_sessions":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid max_sessions %q", value)
+			}
+			p.MaxSessions = n
+		case "bandwidth":
+			p.Bandwidth = value
+		case "egress_ip":
+			if strings.ToLower(value) == "listener" {
+				p.EgressMatchListener = true
+			} else if p.EgressIP = net.ParseIP(value); p.EgressIP == nil {
+				return nil, fmt.Errorf("invalid egress_ip %q", value)
+			}
+		case "egress_interface":
+			p.EgressInterface = value
+		case "allow", "deny":
+			r, err := ParseRule(key + " " + value)
+			if err != nil {
+				return nil, err
+			}
+			p.Rules = append(p.Rules, r)
+		default:
+			return nil, fmt.Errorf("unknown policy attribute %q", key)
+		}
+	}
+	return p, nil
+}
+
+// ParseBandwidthClasses parses "name=rate" pairs separated by commas,rates are
+// bytes per second with an optional k,m or g suffix (powers of 1024),e.g.
+// "basic=512k,premium=10m".
+func ParseBandwidthClasses(text string) (map[string]int64, error) {
+	classes := make(map[string]int64)
+	for _, pair := range strings.Split(text, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth class %q", pair)
+		}
+		value := strings.ToLower(kv[1])
+		unit := int64(1)
+		switch {
+		case strings.HasSuffix(value, "k"):
+			unit = 1 << 10
+		case strings.HasSuffix(value, "m"):
+			unit = 1 << 20
+		case strings.HasSuffix(value, "g"):
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			value = value[:len(value)-1]
+		}
+		rate, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid bandwidth rate %q", kv[1])
+		}
+		classes[kv[0]] = rate * unit
+	}
+	return classes, nil
+}
+
+// rateLimiter is a token bucket allowing rate bytes per second with a burst of one second
+type rateLimiter struct {
+	locker sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), tokens: float64(bytesPerSec), last: time.Now()}
+}
+
+// wait blocks until n more bytes may pass
+func (l *rateLimiter) wait(n int) {
+	l.locker.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.locker.Unlock()
+	time.Sleep(delay)
+}
+
+// limitedConn throttles the writes of a connection
+type limitedConn struct {
+	net.Conn
+	limiter *rateLimiter
+}
+
+func (c *limitedConn) Write(b []byte) (int, error) {
+	c.limiter.wait(len(b))
+	return c.Conn.Write(b)
+}
+
+// userLimiters are the shared upload/download limiters of one user
+type userLimiters struct {
+	up, down *rateLimiter
+}
+
+// bandwidthLimiters returns the limiters of the user's bandwidth class,nil if unlimited
+func (s *Server) bandwidthLimiters(user string, policy *UserPolicy) *userLimiters {
+	if policy == nil || policy.Bandwidth == "" {
+		return nil
+	}
+	rate := s.BandwidthClasses[policy.Bandwidth]
+	if rate <= 0 {
+		return nil
+	}
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	if s.limiters == nil {
+		s.limiters = make(map[string]*userLimiters)
+	}
+	l := s.limiters[user]
+	if l == nil || l.up.rate != float64(rate) {
+		l = &userLimiters{up: newRateLimiter(rate), down: newRateLimiter(rate)}
+		s.limiters[user] = l
+	}
+	return l
+}
@@ -0,0 +1,460 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalanceStrategy is how an UpstreamPool spreads connections over its members.
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin takes the members in turn
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceLeastConn takes the member with the fewest open connections
+	BalanceLeastConn
+	// BalanceLatency prefers members with a low connect latency,weighting
+	// them by its inverse
+	BalanceLatency
+	// BalanceClientHash sends every client to the same member as long as it
+	// is up (rendezvous hashing),so only clients of a failed member move
+	BalanceClientHash
+)
+
+// UpstreamPool balances connections over outbounds,usually proxy chains.
+// Members that fail MaxFails times in a row are left out for FailTimeout,
+// members failing an active probe until they pass one.If the chosen member
+// fails before the destination is reached,e.g. it dies during the handshake,
+// the next one is tried.Direct and interface members are only checked by the
+// probes,their dial errors are those of the destination.
+type UpstreamPool struct {
+	Members  []*Outbound
+	Strategy BalanceStrategy
+	// MaxFails and FailTimeout drive the passive failure detection,
+	// UPSTREAM_MAX_FAILS and UPSTREAM_FAIL_TIMEOUT if zero
+	MaxFails    int
+	FailTimeout time.Duration
+	// ProbeInterval enables active health probes,ProbeTarget is the host:port
+	// every member is asked to connect to.Without a target the first hop of a
+	// proxy member is only connected to.
+	ProbeInterval time.Duration
+	ProbeTarget   string
+	ProbeTimeout  time.Duration
+
+	locker    sync.Mutex
+	state     []*poolMember
+	next      uint64
+	probeOnce sync.Once
+	stop      chan struct{}
+}
+
+type poolMember struct {
+	out *Outbound
+	//accessed atomically
+	active int64
+
+	fails     int
+	downUntil time.Time
+	probeDown bool
+	latency   time.Duration
+}
+
+// UpstreamStatus is the state of a pool member,see UpstreamPool.Status.
+type UpstreamStatus struct {
+	Name    string
+	Up      bool
+	Active  int64
+	Latency time.Duration
+}
+
+// Status returns the state of every member.
+func (p *UpstreamPool) Status() []UpstreamStatus {
+	now := time.Now()
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.init()
+	status := make([]UpstreamStatus, 0, len(p.state))
+	for _, m := range p.state {
+		status = append(status, UpstreamStatus{
+			Name:    m.out.Name,
+			Up:      m.up(now),
+			Active:  atomic.LoadInt64(&m.active),
+			Latency: m.latency,
+		})
+	}
+	return status
+}
+
+// Close stops the health probes.
+func (p *UpstreamPool) Close() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+}
+
+func (m *poolMember) up(now time.Time) bool {
+	return !m.probeDown && !now.Before(m.downUntil)
+}
+
+// init creates the member state,the caller holds the lock
+func (p *UpstreamPool) init() {
+	if len(p.state) == len(p.Members) {
+		return
+	}
+	p.state = make([]*poolMember, len(p.Members))
+	for i, out := range p.Members {
+		p.state[i] = &poolMember{out: out}
+	}
+}
+
+// dial tries the members in the order of the strategy until one connects,
+// the returned connection counts as active until it is closed
+func (p *UpstreamPool) dial(client net.IP, dial func(*Outbound) (net.Conn, error)) (net.Conn, error) {
+	var conn net.Conn
+	err := p.try(client, func(m *poolMember) error {
+		atomic.AddInt64(&m.active, 1)
+		c, err := dial(m.out)
+		if err != nil {
+			atomic.AddInt64(&m.active, -1)
+			return err
+		}
+		conn = &poolConn{Conn: c, member: m}
+		return nil
+	})
+	return conn, err
+}
+
+// try runs attempt with the members in the order of the strategy until it
+// succeeds or fails for a reason the member can't help
+func (p *UpstreamPool) try(client net.IP, attempt func(*poolMember) error) error {
+	p.probeOnce.Do(p.startProbes)
+	members := p.order(client)
+	if len(members) == 0 {
+		return errors.New("upstream pool has no members")
+	}
+	var err error
+	for _, m := range members {
+		start := time.Now()
+		if err = attempt(m); err == nil {
+			p.success(m, time.Since(start))
+			return nil
+		}
+		if !memberFailure(m.out, err) {
+			return err
+		}
+		log.Printf("UPSTREAM %v FAILED: %v\n", m.out.Name, err)
+		p.failure(m)
+	}
+	return err
+}
+
+// memberFailure reports whether err means the member is broken rather than
+// the destination unreachable or refused
+func memberFailure(out *Outbound, err error) bool {
+	if out.Type != OutboundProxy {
+		return false
+	}
+	if _, ok := err.(*RefusedError); ok {
+		return false
+	}
+	return !errors.Is(err, ERR_EGRESS_BLOCKED) && !errors.Is(err, ERR_ROUTE_BLOCKED)
+}
+
+// order returns the members to try,those that are up first in the order of
+// the strategy,then the others in case all of them are down
+func (p *UpstreamPool) order(client net.IP) []*poolMember {
+	now := time.Now()
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.init()
+	var up, down []*poolMember
+	for _, m := range p.state {
+		if m.up(now) {
+			up = append(up, m)
+		} else {
+			down = append(down, m)
+		}
+	}
+	if len(up) > 1 {
+		switch p.Strategy {
+		case BalanceRoundRobin:
+			n := int(p.next % uint64(len(up)))
+			p.next++
+			up = append(up[n:], up[:n]...)
+		case BalanceLeastConn:
+			sortMembers(up, func(a, b *poolMember) bool {
+				return atomic.LoadInt64(&a.active) < atomic.LoadInt64(&b.active)
+			})
+		case BalanceLatency:
+			up = weightedOrder(up)
+		case BalanceClientHash:
+			key := client.String()
+			sortMembers(up, func(a, b *poolMember) bool {
+				return memberScore(key, a.out.Name) > memberScore(key, b.out.Name)
+			})
+		}
+	}
+	return append(up, down...)
+}
+
+// sortMembers is a stable insertion sort,pools are small
+func sortMembers(members []*poolMember, less func(a, b *poolMember) bool) {
+	for i := 1; i < len(members); i++ {
+		for j := i; j > 0 && less(members[j], members[j-1]); j-- {
+			members[j], members[j-1] = members[j-1], members[j]
+		}
+	}
+}
+
+// weightedOrder draws the members at random,weighted by the inverse of their
+// latency.Members without a measurement yet get the weight of the fastest one.
+func weightedOrder(members []*poolMember) []*poolMember {
+	var fastest time.Duration
+	for _, m := range members {
+		if m.latency > 0 && (fastest == 0 || m.latency < fastest) {
+			fastest = m.latency
+		}
+	}
+	weights := make([]float64, len(members))
+	var total float64
+	for i, m := range members {
+		latency := m.latency
+		if latency <= 0 {
+			latency = fastest
+		}
+		weights[i] = 1
+		if latency > 0 {
+			weights[i] = 1 / latency.Seconds()
+		}
+		total += weights[i]
+	}
+	ordered := make([]*poolMember, 0, len(members))
+	for len(members) > 0 {
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(members)-1 && r >= weights[i]; i++ {
+			r -= weights[i]
+		}
+		ordered = append(ordered, members[i])
+		total -= weights[i]
+		members = append(members[:i:i], members[i+1:]...)
+		weights = append(weights[:i:i], weights[i+1:]...)
+	}
+	return ordered
+}
+
+func memberScore(client, member string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(client))
+	h.Write([]byte{0})
+	h.Write([]byte(member))
+	return h.Sum64()
+}
+
+func (p *UpstreamPool) success(m *poolMember, latency time.Duration) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	m.fails = 0
+	m.observe(latency)
+}
+
+func (p *UpstreamPool) failure(m *poolMember) {
+	maxFails, failTimeout := p.MaxFails, p.FailTimeout
+	if maxFails <= 0 {
+		maxFails = UPSTREAM_MAX_FAILS
+	}
+	if failTimeout <= 0 {
+		failTimeout = UPSTREAM_FAIL_TIMEOUT
+	}
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	m.fails++
+	if m.fails >= maxFails {
+		m.fails = 0
+		m.downUntil = time.Now().Add(failTimeout)
+		log.Printf("UPSTREAM %v DOWN FOR %v\n", m.out.Name, failTimeout)
+	}
+}
+
+// observe folds a connect latency into the moving average,the caller holds the lock
+func (m *poolMember) observe(latency time.Duration) {
+	if m.latency == 0 {
+		m.latency = latency
+		return
+	}
+	m.latency = (m.latency*7 + latency*3) / 10
+}
+
+func (p *UpstreamPool) startProbes() {
+	if p.ProbeInterval <= 0 {
+		return
+	}
+	p.locker.Lock()
+	p.init()
+	p.stop = make(chan struct{})
+	stop := p.stop
+	p.locker.Unlock()
+	go func() {
+		ticker := time.NewTicker(p.ProbeInterval)
+		defer ticker.Stop()
+		for {
+			p.probe()
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// probe checks every member once,concurrently
+func (p *UpstreamPool) probe() {
+	p.locker.Lock()
+	members := append([]*poolMember(nil), p.state...)
+	p.locker.Unlock()
+	var wg sync.WaitGroup
+	for _, m := range members {
+		wg.Add(1)
+		go func(m *poolMember) {
+			defer wg.Done()
+			start := time.Now()
+			err := p.probeMember(m.out)
+			latency := time.Since(start)
+			p.locker.Lock()
+			defer p.locker.Unlock()
+			if err != nil {
+				if !m.probeDown {
+					log.Printf("UPSTREAM %v PROBE FAILED: %v\n", m.out.Name, err)
+				}
+				m.probeDown = true
+				return
+			}
+			if m.probeDown {
+				log.Printf("UPSTREAM %v IS UP\n", m.out.Name)
+			}
+			m.probeDown = false
+			m.observe(latency)
+		}(m)
+	}
+	wg.Wait()
+}
+
+func (p *UpstreamPool) probeMember(out *Outbound) error {
+	timeout := p.ProbeTimeout
+	if timeout <= 0 {
+		timeout = UPSTREAM_PROBE_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	switch {
+	case out.Type == OutboundProxy && p.ProbeTarget == "":
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", out.Proxy.Hops[0].Addr)
+	case out.Type == OutboundProxy:
+		conn, err = out.Proxy.DialContext(ctx, "tcp", p.ProbeTarget)
+	case p.ProbeTarget == "":
+		_, err = out.source().localIP(nil, nil)
+	default:
+		d := &net.Dialer{}
+		if err = out.source().apply(d, "tcp", nil, nil); err == nil {
+			conn, err = d.DialContext(ctx, "tcp", p.ProbeTarget)
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return err
+}
+
+// poolConn is a connection through a pool member,counted until it is closed
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	closed int32
+}
+
+func (c *poolConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.member.active, -1)
+	}
+	return c.Conn.Close()
+}
+
+func (c *poolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// parsePool parses the members and settings of a pool outbound:
+//
+//	outbound egress pool least_conn hk,us probe=30s probe_target=www.example.com:443
+func parsePool(name string, args []string, outbounds func(string) *Outbound) (*UpstreamPool, error) {
+	if len(args) < 2 {
+		return nil, fmt.Errorf("outbound %v: pool needs a strategy and members", name)
+	}
+	pool := &UpstreamPool{}
+	switch strings.ToLower(args[0]) {
+	case "round_robin":
+		pool.Strategy = BalanceRoundRobin
+	case "least_conn":
+		pool.Strategy = BalanceLeastConn
+	case "latency":
+		pool.Strategy = BalanceLatency
+	case "client_hash":
+		pool.Strategy = BalanceClientHash
+	default:
+		return nil, fmt.Errorf("outbound %v: unknown strategy %q", name, args[0])
+	}
+	for _, member := range strings.Split(args[1], ",") {
+		out := outbounds(member)
+		if out == nil {
+			return nil, fmt.Errorf("outbound %v: unknown member %q", name, member)
+		}
+		if out.Type == OutboundPool || out.Type == OutboundBlock {
+			return nil, fmt.Errorf("outbound %v: member %q can't be a pool or block", name, member)
+		}
+		pool.Members = append(pool.Members, out)
+	}
+	for _, field := range args[2:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("outbound %v: invalid setting %q", name, field)
+		}
+		var err error
+		switch strings.ToLower(kv[0]) {
+		case "probe":
+			pool.ProbeInterval, err = time.ParseDuration(kv[1])
+		case "probe_target":
+			pool.ProbeTarget = kv[1]
+		case "probe_timeout":
+			pool.ProbeTimeout, err = time.ParseDuration(kv[1])
+		case "max_fails":
+			pool.MaxFails, err = strconv.Atoi(kv[1])
+		case "fail_timeout":
+			pool.FailTimeout, err = time.ParseDuration(kv[1])
+		default:
+			return nil, fmt.Errorf("outbound %v: unknown setting %q", name, kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("outbound %v: invalid setting %q", name, field)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,148 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPool(strategy BalanceStrategy, names ...string) *UpstreamPool {
+	pool := &UpstreamPool{Strategy: strategy}
+	for _, name := range names {
+		pool.Members = append(pool.Members, &Outbound{Name: name, Type: OutboundProxy})
+	}
+	return pool
+}
+
+// fakeDial connects through every member but those in fail,which answer
+// with their error,and records the members in the order they were asked
+func fakeDial(dialed *[]string, fail map[string]error) func(*Outbound) (net.Conn, error) {
+	return func(out *Outbound) (net.Conn, error) {
+		*dialed = append(*dialed, out.Name)
+		if err := fail[out.Name]; err != nil {
+			return nil, err
+		}
+		conn, _ := net.Pipe()
+		return conn, nil
+	}
+}
+
+// firstPick is the member the pool tries first for client
+func firstPick(p *UpstreamPool, client net.IP) string {
+	return p.order(client)[0].out.Name
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	pool := testPool(BalanceRoundRobin, "a", "b", "c")
+	var picks []string
+	for i := 0; i < 6; i++ {
+		picks = append(picks, firstPick(pool, nil))
+	}
+	if got := strings.Join(picks, ","); got != "a,b,c,a,b,c" {
+		t.Errorf("picked %v", got)
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	pool := testPool(BalanceLeastConn, "a", "b", "c")
+	var dialed []string
+	conns := map[string][]net.Conn{}
+	for i := 0; i < 3; i++ {
+		conn, err := pool.dial(nil, fakeDial(&dialed, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := dialed[len(dialed)-1]
+		conns[name] = append(conns[name], conn)
+	}
+	if got := strings.Join(dialed, ","); got != "a,b,c" {
+		t.Fatalf("dialed %v,want every member once", got)
+	}
+	//b has the fewest connections once its one is closed,twice is counted once
+	conns["b"][0].Close()
+	conns["b"][0].Close()
+	if status := pool.Status(); status[0].Active != 1 || status[1].Active != 0 || status[2].Active != 1 {
+		t.Fatalf("active connections %+v", status)
+	}
+	if got := firstPick(pool, nil); got != "b" {
+		t.Errorf("picked %v,want b", got)
+	}
+}
+
+func TestPoolLatency(t *testing.T) {
+	pool := testPool(BalanceLatency, "slow", "fast")
+	pool.order(nil)
+	pool.state[0].latency = 100 * time.Millisecond
+	pool.state[1].latency = time.Millisecond
+	fast := 0
+	for i := 0; i < 1000; i++ {
+		if firstPick(pool, nil) == "fast" {
+			fast++
+		}
+	}
+	//the fast member is weighted 100:1
+	if fast < 950 {
+		t.Errorf("fast member picked %v of 1000 times", fast)
+	}
+}
+
+func TestPoolClientHash(t *testing.T) {
+	pool := testPool(BalanceClientHash, "a", "b", "c")
+	moved := 0
+	for i := 0; i < 100; i++ {
+		client := net.IPv4(192, 0, 2, byte(i))
+		first := firstPick(pool, client)
+		if firstPick(pool, client) != first {
+			t.Fatalf("client %v moved between members", client)
+		}
+		//only the clients of a member that goes down move
+		pool.state[2].downUntil = time.Now().Add(time.Minute)
+		if got := firstPick(pool, client); got != first && first != "c" {
+			moved++
+		}
+		pool.state[2].downUntil = time.Time{}
+	}
+	if moved > 0 {
+		t.Errorf("%v clients of members that stayed up moved", moved)
+	}
+}
+
+func TestPoolFailover(t *testing.T) {
+	pool := testPool(BalanceRoundRobin, "a", "b")
+	pool.MaxFails = 2
+	var dialed []string
+	broken := map[string]error{"a": errors.New("connection reset by peer")}
+
+	//a broken member is skipped and left out after MaxFails
+	for i := 0; i < 2; i++ {
+		dialed = nil
+		pool.next = 0
+		conn, err := pool.dial(nil, fakeDial(&dialed, broken))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if got := strings.Join(dialed, ","); got != "a,b" {
+			t.Errorf("dialed %v,want a then b", got)
+		}
+	}
+	if status := pool.Status(); status[0].Up || !status[1].Up {
+		t.Errorf("status %+v,want a down", status)
+	}
+
+	//a member refusing the destination is working,the next one isn't asked
+	pool = testPool(BalanceRoundRobin, "a", "b")
+	dialed = nil
+	refused := &RefusedError{Proxy: "socks5 a", Target: "192.0.2.1:80", Reason: "connection refused"}
+	if _, err := pool.dial(nil, fakeDial(&dialed, map[string]error{"a": refused})); err != refused {
+		t.Errorf("got %v,want the refusal", err)
+	}
+	if got := strings.Join(dialed, ","); got != "a" {
+		t.Errorf("dialed %v,want only a", got)
+	}
+	if status := pool.Status(); !status[0].Up || status[0].Active != 0 {
+		t.Errorf("status %+v,want a up and idle", status)
+	}
+}
@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+const benchChunkSize = 32 * 1024
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(tb testing.TB) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		tb.Fatal("accept failed")
+	}
+	return dialed, conn
+}
+
+// benchmarkCopy relays b.N chunks from a writer to a reader through copyBuffer
+// over loopback TCP,wrap decides the connection types copyBuffer sees
+func benchmarkCopy(b *testing.B, wrap func(net.Conn) net.Conn) {
+	writer, src := tcpPair(b)
+	dst, reader := tcpPair(b)
+	defer writer.Close()
+	defer src.Close()
+	defer dst.Close()
+	defer reader.Close()
+
+	var written int64
+	copied := make(chan error, 1)
+	go func() {
+		_, err := copyBuffer(dst, wrap(src), &written)
+		dst.(*net.TCPConn).CloseWrite()
+		copied <- err
+	}()
+	drained := make(chan int64, 1)
+	go func() {
+		n, _ := io.Copy(ioutil.Discard, reader)
+		drained <- n
+	}()
+
+	chunk := make([]byte, benchChunkSize)
+	b.SetBytes(benchChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := writer.Write(chunk); err != nil {
+			b.Fatal(err)
+		}
+	}
+	writer.(*net.TCPConn).CloseWrite()
+	if err := <-copied; err != nil {
+		b.Fatal(err)
+	}
+	n := <-drained
+	b.StopTimer()
+	if want := int64(b.N) * benchChunkSize; n != want || written != want {
+		b.Fatalf("relayed %v bytes,counted %v,want %v", n, written, want)
+	}
+}
+
+// BenchmarkCopySplice relays between plain TCP connections,which takes the
+// ReadFrom (splice(2) on Linux) path.
+func BenchmarkCopySplice(b *testing.B) {
+	benchmarkCopy(b, func(conn net.Conn) net.Conn { return conn })
+}
+
+// BenchmarkCopyBuffered relays with an idle timeout set,which takes the pooled
+// buffer path the relay always used before.
+func BenchmarkCopyBuffered(b *testing.B) {
+	benchmarkCopy(b, func(conn net.Conn) net.Conn { return idleConn(conn, time.Hour) })
+}
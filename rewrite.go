@@ -0,0 +1,202 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Rewrite sends requests for matching destinations to another one.
+type Rewrite struct {
+	// Domain matches requests by host name,an exact name or a "*.example.com"
+	// wildcard,Net matches requests by address.One of them is set.
+	Domain string
+	Net    *net.IPNet
+	// Port restricts the rewrite to one port,0 matches every port
+	Port int
+
+	// ToHost is the new host name or address,empty keeps the host.ToNet maps
+	// the Net matched onto a network of the same size,keeping the host bits.
+	ToHost string
+	ToNet  *net.IPNet
+	// ToPort is the new port,0 keeps the port
+	ToPort int
+}
+
+// Rewriter maps the destinations clients ask for to others,e.g. to send them
+// to staging backends without touching the clients.Rewrites are tried in
+// order,the first match applies.CONNECT and BIND requests are rewritten as
+// soon as they are read,UDP datagrams one by one,and the replies carry the
+// address the client asked for.Domain rewrites only match requests by name,
+// Net rewrites requests by address.Hosts a rewrite sends requests to may be
+// internal,the egress guard only keeps them off the proxy's own listeners,
+// rewrites keeping the host are checked as usual.
+type Rewriter struct {
+	Rewrites []*Rewrite
+}
+
+// Rewrite returns the destination host:port is sent to,ok is false if no
+// rewrite matches.
+func (r *Rewriter) Rewrite(host string, port int) (string, int, bool) {
+	toHost, toPort, rw := r.rewrite(host, port)
+	return toHost, toPort, rw != nil
+}
+
+// rewrite is Rewrite returning the rewrite applied,nil if none matches
+func (r *Rewriter) rewrite(host string, port int) (string, int, *Rewrite) {
+	if r == nil {
+		return host, port, nil
+	}
+	ip := net.ParseIP(host)
+	for _, rw := range r.Rewrites {
+		if rw.Port != 0 && rw.Port != port {
+			continue
+		}
+		if ip == nil {
+			if rw.Domain == "" || !matchDomainPattern(rw.Domain, strings.ToLower(strings.TrimSuffix(host, "."))) {
+				continue
+			}
+		} else if rw.Net == nil || !rw.Net.Contains(ip) {
+			continue
+		}
+		toHost, toPort := host, port
+		switch {
+		case rw.ToNet != nil:
+			toHost = remapIP(ip, rw.Net, rw.ToNet).String()
+		case rw.ToHost != "":
+			toHost = rw.ToHost
+		}
+		if rw.ToPort != 0 {
+			toPort = rw.ToPort
+		}
+		return toHost, toPort, rw
+	}
+	return host, port, nil
+}
+
+// picksHost reports whether the rewrite chooses the host,rather than keeping
+// the one the client asked for
+func (rw *Rewrite) picksHost() bool {
+	return rw.ToHost != "" || rw.ToNet != nil
+}
+
+// remapIP moves ip from the network from to the network to,keeping its host bits
+func remapIP(ip net.IP, from, to *net.IPNet) net.IP {
+	if ip4 := ip.To4(); ip4 != nil && len(from.IP) == net.IPv4len {
+		ip = ip4
+	}
+	mapped := make(net.IP, len(ip))
+	for i := range ip {
+		mapped[i] = to.IP[i]&to.Mask[i] | ip[i]&^from.Mask[i]
+	}
+	return mapped
+}
+
+// ParseRewrites reads one rewrite per line,what is requested and where it is
+// sent,skipping blank lines and # comments:
+//
+//	api.example.com:443 10.0.0.5:8443
+//	*.svc.example.com staging-lb.internal
+//	10.1.0.0/16 10.2.0.0/16
+//	192.0.2.53:53 :5353
+//	[2001:db8::1]:443 [2001:db8::2]
+//
+// Without a port every port matches and the port is kept,a target without a
+// host keeps the host.A network may only be mapped onto one of the same size.
+func ParseRewrites(rd io.Reader) (*Rewriter, error) {
+	r := &Rewriter{}
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: a rewrite needs a destination and a target", n)
+		}
+		rw, err := parseRewrite(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		r.Rewrites = append(r.Rewrites, rw)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseRewrite(from, to string) (*Rewrite, error) {
+	rw := &Rewrite{}
+	host, port, err := splitRewriteAddr(from)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing destination host in %q", from)
+	}
+	rw.Port = port
+	if strings.Contains(host, "/") || net.ParseIP(host) != nil {
+		if rw.Net, err = parseCIDR(host); err != nil {
+			return nil, err
+		}
+	} else {
+		rw.Domain = strings.ToLower(host)
+	}
+	if host, rw.ToPort, err = splitRewriteAddr(to); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(host, "/") {
+		rw.ToHost = host
+		return rw, nil
+	}
+	if rw.Net == nil {
+		return nil, fmt.Errorf("%v: only networks can be mapped onto networks", to)
+	}
+	if rw.ToNet, err = parseCIDR(host); err != nil {
+		return nil, err
+	}
+	fromOnes, fromBits := rw.Net.Mask.Size()
+	toOnes, toBits := rw.ToNet.Mask.Size()
+	if fromOnes != toOnes || fromBits != toBits {
+		return nil, fmt.Errorf("%v and %v differ in size", rw.Net, rw.ToNet)
+	}
+	return rw, nil
+}
+
+// splitRewriteAddr splits host:port,host,[v6]:port,cidr:port or :port
+func splitRewriteAddr(s string) (string, int, error) {
+	host, portStr := s, ""
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		if j := strings.Index(s[i:], ":"); j >= 0 {
+			host, portStr = s[:i+j], s[i+j+1:]
+		}
+	} else if h, p, err := net.SplitHostPort(s); err == nil {
+		host, portStr = h, p
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		host = s[1 : len(s)-1]
+	}
+	if portStr == "" {
+		return host, 0, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xffff {
+		return "", 0, fmt.Errorf("invalid port %q", portStr)
+	}
+	return host, port, nil
+}
+
+// LoadRewrites reads a rewrite file,see ParseRewrites.
+func LoadRewrites(path string) (*Rewriter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRewrites(f)
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRewriteEgress checks that hosts an operator's rewrite picks get past
+// the egress guard,which still blocks the same hosts requested directly
+func TestRewriteEgress(t *testing.T) {
+	target := halfCloseTarget(t)
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+
+	s := NewSocks5Server(&defConfig{Port: "0", defAuth: &defAuth{}})
+	listener := listenTest(t)
+	defer listener.Close()
+	rewriter, err := ParseRewrites(strings.NewReader(fmt.Sprintf(`
+api.example.com:443 127.0.0.1:%v
+127.0.0.2:80 :%v
+self.example.com:80 %v
+`, port, port, listener.Addr())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Rewriter = rewriter
+	go s.Serve(listener, nil)
+	client := &Client{Addr: listener.Addr().String(), Timeout: 5 * time.Second}
+
+	conn, err := client.Dial("tcp", "api.example.com:443")
+	if err != nil {
+		t.Fatalf("rewritten to an internal host: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if got := roundTrip(t, conn, "hello"); got != "reply:hello" {
+		t.Errorf("got %q from the rewrite target", got)
+	}
+	conn.Close()
+
+	for _, addr := range []string{
+		//the same host requested directly
+		target.Addr().String(),
+		//a rewrite keeping the requested host
+		"127.0.0.2:80",
+		//the proxy itself
+		"self.example.com:80",
+	} {
+		if conn, err := client.Dial("tcp", addr); err == nil {
+			conn.Close()
+			t.Errorf("%v passed the egress guard", addr)
+		} else if !strings.Contains(err.Error(), replyText[2]) {
+			t.Errorf("%v: got %v,want a refusal by the ruleset", addr, err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RuleAction is what happens to a request matched by a Rule.
+type RuleAction int
+
+const (
+	RuleAllow RuleAction = iota
+	RuleDeny
+)
+
+// PortRange is an inclusive range of destination ports.
+type PortRange struct {
+	From, To int
+}
+
+// Rule matches a request on its destination, command, client and user.
+// Every non-empty criterion has to match,an empty one matches anything.
+type Rule struct {
+	Action RuleAction
+	// Commands holds CMD_CONNECT,CMD_BIND or CMD_UDP_ASSOCIATE
+	Commands []int
+	// Destinations match any of the resolved destination addresses
+	Destinations []*net.IPNet
+	// Domains are exact names or wildcards like "*.example.com",they never
+	// match requests that were made by IP address
+	Domains       []string
+	DomainRegexps []*regexp.Regexp
+	Ports         []PortRange
+	Sources       []*net.IPNet
+	Users         []string
+}
+
+// RuleRequest is the request a Rule is matched against.
+type RuleRequest struct {
+	Command int
+	// Domain is the requested name,empty if the client sent an address
+	Domain string
+	// IPs are the destination addresses,resolved from Domain if necessary
+	IPs    []net.IP
+	Port   int
+	Client net.IP
+	User   string
+}
+
+// Match reports whether every criterion of the rule matches req.
+func (r *Rule) Match(req *RuleRequest) bool {
+	if len(r.Commands) > 0 && !containsInt(r.Commands, req.Command) {
+		return false
+	}
+	if len(r.Destinations) > 0 && !anyIPInNets(r.Destinations, req.IPs...) {
+		return false
+	}
+	if len(r.Domains) > 0 || len(r.DomainRegexps) > 0 {
+		if req.Domain == "" || !r.matchDomain(req.Domain) {
+			return false
+		}
+	}
+	if len(r.Ports) > 0 {
+		matched := false
+		for _, p := range r.Ports {
+			if req.Port >= p.From && req.Port <= p.To {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(r.Sources) > 0 && !anyIPInNets(r.Sources, req.Client) {
+		return false
+	}
+	if len(r.Users) > 0 && !containsString(r.Users, req.User) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) matchDomain(domain string) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for _, d := range r.Domains {
+		if matchDomainPattern(d, domain) {
+			return true
+		}
+	}
+	for _, re := range r.DomainRegexps {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDomainPattern matches a lower case domain against an exact name or a
+// "*.example.com" wildcard,which covers every subdomain but not the apex.
+func matchDomainPattern(pattern, domain string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(domain, pattern[1:])
+	}
+	return pattern == domain
+}
+
+// RuleSet evaluates its rules in order,the first matching rule decides.
+// Requests no rule matches get DefaultAction.A nil RuleSet allows everything.
+//
+// CONNECT and BIND are checked once the request has been read,UDP ASSOCIATE is
+// checked for every datagram.A CONNECT to a name is only dialed at those of
+// its addresses the rules allow on their own.
+type RuleSet struct {
+	Rules         []*Rule
+	DefaultAction RuleAction
+}
+
+// Evaluate returns whether req is allowed and the rule that decided,nil if
+// the default action applied.
+func (rs *RuleSet) Evaluate(req *RuleRequest) (bool, *Rule) {
+	if rs == nil {
+		return true, nil
+	}
+	for _, r := range rs.Rules {
+		if r.Match(req) {
+			return r.Action == RuleAllow, r
+		}
+	}
+	return rs.DefaultAction == RuleAllow, nil
+}
+
+// Allow reports whether req is allowed.
+func (rs *RuleSet) Allow(req *RuleRequest) bool {
+	allowed, _ := rs.Evaluate(req)
+	return allowed
+}
+
+// ParseRule parses one rule written as an action followed by criteria,e.g.
+//
+//	deny dst=10.0.0.0/8,192.168.0.0/16
+//	allow cmd=connect domain=*.example.com port=443,8000-8999 user=alice
+//	deny regex=^ads\. src=203.0.113.0/24
+//
+// Criteria keys are cmd (connect,bind,udp),dst,domain,regex,port,src and user,
+// values are comma separated.
+func ParseRule(line string) (*Rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty rule")
+	}
+	action, err := parseAction(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	r := &Rule{Action: action}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid rule criterion %q", field)
+		}
+		for _, v := range strings.Split(kv[1], ",") {
+			if err := r.addCriterion(strings.ToLower(kv[0]), v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *Rule) addCriterion(key, value string) error {
+	switch key {
+	case "cmd":
+		cmd, err := parseCommand(value)
+		if err != nil {
+			return err
+		}
+		r.Commands = append(r.Commands, cmd)
+	case "dst":
+		n, err := parseCIDR(value)
+		if err != nil {
+			return err
+		}
+		r.Destinations = append(r.Destinations, n)
+	case "src":
+		n, err := parseCIDR(value)
+		if err != nil {
+			return err
+		}
+		r.Sources = append(r.Sources, n)
+	case "domain":
+		r.Domains = append(r.Domains, value)
+	case "regex":
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return err
+		}
+		r.DomainRegexps = append(r.DomainRegexps, re)
+	case "port":
+		p, err := parsePortRange(value)
+		if err != nil {
+			return err
+		}
+		r.Ports = append(r.Ports, p)
+	case "user":
+		r.Users = append(r.Users, value)
+	default:
+		return fmt.Errorf("unknown rule criterion %q", key)
+	}
+	return nil
+}
+
+// ParseRules reads one rule per line,skipping blank lines and # comments.
+// A line "default allow" or "default deny" sets the default action.
+func ParseRules(rd io.Reader) (*RuleSet, error) {
+	rs := &RuleSet{}
+	scanner := bufio.NewScanner(rd)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if fields := strings.Fields(line); strings.ToLower(fields[0]) == "default" {
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("line %v: invalid default action", n)
+			}
+			action, err := parseAction(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %v", n, err)
+			}
+			rs.DefaultAction = action
+			continue
+		}
+		r, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		rs.Rules = append(rs.Rules, r)
+	}
+	return rs, scanner.Err()
+}
+
+// LoadRules reads a rule file,see ParseRules.
+func LoadRules(path string) (*RuleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+func parseAction(s string) (RuleAction, error) {
+	switch strings.ToLower(s) {
+	case "allow":
+		return RuleAllow, nil
+	case "deny":
+		return RuleDeny, nil
+	}
+	return RuleAllow, fmt.Errorf("unknown rule action %q", s)
+}
+
+func parseCommand(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "connect":
+		return CMD_CONNECT, nil
+	case "bind":
+		return CMD_BIND, nil
+	case "udp", "associate":
+		return CMD_UDP_ASSOCIATE, nil
+	}
+	return 0, fmt.Errorf("unknown command %q", s)
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs or single addresses.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		n, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// parseCIDR accepts a CIDR or a single address
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, n, err := net.ParseCIDR(s)
+	return n, err
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	from, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return PortRange{}, fmt.Errorf("invalid port %q", s)
+	}
+	to := from
+	if len(bounds) == 2 {
+		if to, err = strconv.Atoi(bounds[1]); err != nil {
+			return PortRange{}, fmt.Errorf("invalid port %q", s)
+		}
+	}
+	if from < 0 || to > 65535 || from > to {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: from, To: to}, nil
+}
+
+func anyIPInNets(nets []*net.IPNet, ips ...net.IP) bool {
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, v int) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		line    string
+		wantErr bool
+	}{
+		{"deny dst=10.0.0.0/8,192.168.0.0/16", false},
+		{"allow cmd=connect,udp domain=*.example.com port=443,8000-8999 user=alice", false},
+		{"deny regex=^ads\\. src=203.0.113.0/24", false},
+		{"ALLOW DST=2001:db8::1", false},
+		{"", true},
+		{"permit dst=10.0.0.0/8", true},
+		{"deny dst", true},
+		{"deny dst=", true},
+		{"deny dst=example.com", true},
+		{"deny cmd=ping", true},
+		{"deny port=80-20", true},
+		{"deny port=70000", true},
+		{"deny regex=(", true},
+		{"deny color=red", true},
+	}
+	for _, tt := range tests {
+		_, err := ParseRule(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRule(%q) error = %v,want error %v", tt.line, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRuleSetEvaluate(t *testing.T) {
+	rs, err := ParseRules(strings.NewReader(`
+# comments and blank lines are skipped
+
+allow user=admin
+deny dst=10.0.0.0/8
+allow domain=*.example.com port=443
+deny regex=^ads\.
+allow cmd=udp dst=192.0.2.0/24 src=198.51.100.0/24
+default deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := net.ParseIP("198.51.100.7")
+	tests := []struct {
+		name string
+		req  *RuleRequest
+		want bool
+		rule int
+	}{
+		{"first match wins over a later deny", &RuleRequest{Command: CMD_CONNECT, IPs: []net.IP{net.ParseIP("10.1.2.3")}, Port: 22, Client: client, User: "admin"}, true, 0},
+		{"private destination", &RuleRequest{Command: CMD_CONNECT, IPs: []net.IP{net.ParseIP("10.1.2.3")}, Port: 443, Client: client, User: "bob"}, false, 1},
+		{"any resolved address matches", &RuleRequest{Command: CMD_CONNECT, Domain: "www.example.com", IPs: []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("10.0.0.1")}, Port: 443, Client: client}, false, 1},
+		{"wildcard domain and port", &RuleRequest{Command: CMD_CONNECT, Domain: "WWW.Example.com.", IPs: []net.IP{net.ParseIP("192.0.2.1")}, Port: 443, Client: client}, true, 2},
+		{"wildcard skips the apex", &RuleRequest{Command: CMD_CONNECT, Domain: "example.com", IPs: []net.IP{net.ParseIP("192.0.2.1")}, Port: 443, Client: client}, false, -1},
+		{"wrong port", &RuleRequest{Command: CMD_CONNECT, Domain: "www.example.com", IPs: []net.IP{net.ParseIP("192.0.2.1")}, Port: 80, Client: client}, false, -1},
+		{"regex", &RuleRequest{Command: CMD_CONNECT, Domain: "ads.example.org", IPs: []net.IP{net.ParseIP("192.0.2.1")}, Port: 80, Client: client}, false, 3},
+		{"domain rules never match addresses", &RuleRequest{Command: CMD_CONNECT, IPs: []net.IP{net.ParseIP("192.0.2.1")}, Port: 443, Client: client}, false, -1},
+		{"command,destination and source", &RuleRequest{Command: CMD_UDP_ASSOCIATE, IPs: []net.IP{net.ParseIP("192.0.2.53")}, Port: 53, Client: client}, true, 4},
+		{"other source", &RuleRequest{Command: CMD_UDP_ASSOCIATE, IPs: []net.IP{net.ParseIP("192.0.2.53")}, Port: 53, Client: net.ParseIP("203.0.113.1")}, false, -1},
+		{"other command", &RuleRequest{Command: CMD_CONNECT, IPs: []net.IP{net.ParseIP("192.0.2.53")}, Port: 53, Client: client}, false, -1},
+	}
+	for _, tt := range tests {
+		allowed, rule := rs.Evaluate(tt.req)
+		if allowed != tt.want {
+			t.Errorf("%v: allowed = %v,want %v", tt.name, allowed, tt.want)
+		}
+		var want *Rule
+		if tt.rule >= 0 {
+			want = rs.Rules[tt.rule]
+		}
+		if rule != want {
+			t.Errorf("%v: decided by %+v,want %+v", tt.name, rule, want)
+		}
+	}
+}
+
+func TestRuleSetDefaults(t *testing.T) {
+	var nilSet *RuleSet
+	if !nilSet.Allow(&RuleRequest{}) {
+		t.Error("a nil RuleSet must allow everything")
+	}
+	rs, err := ParseRules(strings.NewReader("deny port=25\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rs.Allow(&RuleRequest{Port: 80}) {
+		t.Error("the default action must be allow")
+	}
+	if rs.Allow(&RuleRequest{Port: 25}) {
+		t.Error("port 25 must be denied")
+	}
+	if _, err := ParseRules(strings.NewReader("default\n")); err == nil {
+		t.Error("a default without action must fail")
+	}
+	if _, err := ParseRules(strings.NewReader("allow\ndeny bogus\n")); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("error %v should name line 2", err)
+	}
+}
+
+// TestRulesCheckDialedAddresses checks that a name is dialed by the addresses
+// the rules allowed,not resolved again or dialed at an address they don't allow
+func TestRulesCheckDialedAddresses(t *testing.T) {
+	s := newTestServer(t)
+	rs, err := ParseRules(strings.NewReader("allow dst=127.0.0.1/32\ndefault deny\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Rules = rs
+	var dialed []string
+	s.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		conn, _ := net.Pipe()
+		return conn, nil
+	})
+	//app.test has two addresses,the rules allow the request for the second
+	req := &TCPRequest{
+		cmd:        CMD_CONNECT,
+		domain:     "app.test",
+		targetIPs:  []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")},
+		TargetAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.2"), Port: 80},
+		clientAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+	}
+	conn := &TCPConn{server: s, request: req}
+	if !conn.allowedByRules(req) {
+		t.Fatal("request refused")
+	}
+	target, err := conn.dialTarget(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	if len(dialed) != 1 || dialed[0] != "127.0.0.1:80" {
+		t.Errorf("dialed %v,want only 127.0.0.1:80", dialed)
+	}
+
+	req.targetIPs = req.targetIPs[:1]
+	if _, err := conn.dialTarget(req); err != ERR_RULESET {
+		t.Errorf("got %v,want %v", err, ERR_RULESET)
+	}
+}
@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session is one proxied client request (CONNECT, BIND or UDP ASSOCIATE).
+type Session struct {
+	//accessed atomically,keep them first for 64-bit alignment
+	bytesSent     int64
+	bytesReceived int64
+
+	ID      uint64
+	Command int
+	Client  net.Addr
+	Target  net.Addr
+	User    string
+	Start   time.Time
+	//what the Config's Authenticator returned for the client
+	Identity *Identity
+
+	policy     *UserPolicy
+	clientConn net.Conn
+	targetConn net.Conn
+	//UDP ASSOCIATE only,datagrams are accepted from this address
+	udpClient *net.UDPAddr
+}
+
+// BytesSent returns the bytes the client sent towards the target so far.
+func (s *Session) BytesSent() int64 {
+	return atomic.LoadInt64(&s.bytesSent)
+}
+
+// BytesReceived returns the bytes the target sent back to the client so far.
+func (s *Session) BytesReceived() int64 {
+	return atomic.LoadInt64(&s.bytesReceived)
+}
+
+// Close closes the connections of the session,which ends its relay.
+func (s *Session) Close() {
+	if s.clientConn != nil {
+		s.clientConn.Close()
+	}
+	if s.targetConn != nil {
+		s.targetConn.Close()
+	}
+}
+
+// acceptsUDP reports whether a datagram from addr belongs to this UDP association.
+func (s *Session) acceptsUDP(addr *net.UDPAddr) bool {
+	if s.Command != CMD_UDP_ASSOCIATE || s.udpClient == nil {
+		return false
+	}
+	if !s.udpClient.IP.Equal(addr.IP) {
+		return false
+	}
+	return s.udpClient.Port == 0 || s.udpClient.Port == addr.Port
+}
+
+// udpKey is the key of a UDP ASSOCIATE session in the registry's index,empty
+// for other sessions
+func (s *Session) udpKey() string {
+	if s == nil || s.Command != CMD_UDP_ASSOCIATE || s.udpClient == nil {
+		return ""
+	}
+	return s.udpClient.IP.String()
+}
+
+// SessionRegistry tracks the active sessions of a server,keyed by IDs that are
+// unique for the lifetime of the process.
+type SessionRegistry struct {
+	lastID   uint64
+	locker   sync.RWMutex
+	sessions map[uint64]*Session
+	//UDP ASSOCIATE sessions by the IP of their client,for udpAssociation
+	udp map[string][]*Session
+	//active requests per user,for UserPolicy.MaxSessions
+	users map[string]int
+}
+
+func newSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{
+		sessions: make(map[uint64]*Session),
+		udp:      make(map[string][]*Session),
+		users:    make(map[string]int),
+	}
+}
+
+// NewID hands out the next session ID.
+func (r *SessionRegistry) NewID() uint64 {
+	return atomic.AddUint64(&r.lastID, 1)
+}
+
+// Add registers a session,assigning an ID if it has none.
+func (r *SessionRegistry) Add(s *Session) *Session {
+	if s.ID == 0 {
+		s.ID = r.NewID()
+	}
+	if s.Start.IsZero() {
+		s.Start = time.Now()
+	}
+	r.locker.Lock()
+	r.sessions[s.ID] = s
+	if key := s.udpKey(); key != "" {
+		r.udp[key] = append(r.udp[key], s)
+	}
+	r.locker.Unlock()
+	return s
+}
+
+// Remove unregisters the session and closes its connections.
+func (r *SessionRegistry) Remove(id uint64) {
+	r.locker.Lock()
+	s := r.sessions[id]
+	delete(r.sessions, id)
+	if key := s.udpKey(); key != "" {
+		r.removeUDP(key, s)
+	}
+	r.locker.Unlock()
+	if s != nil {
+		s.Close()
+	}
+}
+
+// Get returns the session with the given ID or nil.
+func (r *SessionRegistry) Get(id uint64) *Session {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return r.sessions[id]
+}
+
+// Len returns the number of active sessions.
+func (r *SessionRegistry) Len() int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return len(r.sessions)
+}
+
+// Sessions returns a snapshot of the active sessions.
+func (r *SessionRegistry) Sessions() []*Session {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	list := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		list = append(list, s)
+	}
+	return list
+}
+
+// udpAssociation finds the UDP ASSOCIATE session a datagram from addr belongs to.
+func (r *SessionRegistry) udpAssociation(addr *net.UDPAddr) *Session {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	for _, s := range r.udp[addr.IP.String()] {
+		if s.acceptsUDP(addr) {
+			return s
+		}
+	}
+	return nil
+}
+
+// removeUDP drops s from the UDP index,the caller holds the lock
+func (r *SessionRegistry) removeUDP(key string, s *Session) {
+	list := r.udp[key]
+	for i, other := range list {
+		if other == s {
+			list = append(list[:i:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(r.udp, key)
+		return
+	}
+	r.udp[key] = list
+}
+
+// acquireUser takes one of the max session slots of user,max <= 0 is unlimited.
+// Every successful call must be paired with releaseUser.
+func (r *SessionRegistry) acquireUser(user string, max int) bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if max > 0 && r.users[user] >= max {
+		return false
+	}
+	r.users[user]++
+	return true
+}
+
+func (r *SessionRegistry) releaseUser(user string) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.users[user]--; r.users[user] <= 0 {
+		delete(r.users, user)
+	}
+}
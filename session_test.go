@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSessionRegistryUDP(t *testing.T) {
+	r := newSessionRegistry()
+	client := net.ParseIP("192.0.2.7")
+	first := r.Add(&Session{Command: CMD_UDP_ASSOCIATE, udpClient: &net.UDPAddr{IP: client, Port: 5000}})
+	second := r.Add(&Session{Command: CMD_UDP_ASSOCIATE, udpClient: &net.UDPAddr{IP: client, Port: 6000}})
+	//a client that announced port 0 may send from any port
+	anyPort := r.Add(&Session{Command: CMD_UDP_ASSOCIATE, udpClient: &net.UDPAddr{IP: net.ParseIP("2001:db8::7")}})
+	r.Add(&Session{Command: CMD_CONNECT})
+
+	tests := []struct {
+		addr *net.UDPAddr
+		want *Session
+	}{
+		{&net.UDPAddr{IP: client, Port: 5000}, first},
+		{&net.UDPAddr{IP: client.To16(), Port: 6000}, second},
+		{&net.UDPAddr{IP: client, Port: 7000}, nil},
+		{&net.UDPAddr{IP: net.ParseIP("192.0.2.8"), Port: 5000}, nil},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::7"), Port: 53}, anyPort},
+	}
+	for _, tt := range tests {
+		if got := r.udpAssociation(tt.addr); got != tt.want {
+			t.Errorf("%v: got session %+v,want %+v", tt.addr, got, tt.want)
+		}
+	}
+
+	r.Remove(first.ID)
+	if got := r.udpAssociation(&net.UDPAddr{IP: client, Port: 5000}); got != nil {
+		t.Errorf("removed session still found: %+v", got)
+	}
+	if got := r.udpAssociation(&net.UDPAddr{IP: client, Port: 6000}); got != second {
+		t.Errorf("got %+v,want the second session", got)
+	}
+	r.Remove(second.ID)
+	r.Remove(anyPort.ID)
+	if len(r.udp) != 0 {
+		t.Errorf("index not emptied: %v", r.udp)
+	}
+}
+
+func TestAcquireUser(t *testing.T) {
+	r := newSessionRegistry()
+	if !r.acquireUser("alice", 2) || !r.acquireUser("alice", 2) {
+		t.Fatal("alice refused below her limit")
+	}
+	if r.acquireUser("alice", 2) {
+		t.Error("alice got a third session")
+	}
+	if !r.acquireUser("bob", 2) {
+		t.Error("the limit of alice applied to bob")
+	}
+	r.releaseUser("alice")
+	if !r.acquireUser("alice", 2) {
+		t.Error("released slot not given back")
+	}
+	for i := 0; i < 10; i++ {
+		if !r.acquireUser("carol", 0) {
+			t.Fatal("no limit refused")
+		}
+	}
+}
+
+func TestUserMaxSessions(t *testing.T) {
+	target := halfCloseTarget(t)
+	defer target.Close()
+	config := &defConfig{Port: "0", defAuth: &defAuth{userInfo: map[string]string{"alice": "secret"}}, hasAuth: true}
+	if err := config.setUserPolicy("max_sessions=1", "", false); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSocks5Server(config)
+	s.Egress.Allowed = mustParseCIDRs("127.0.0.0/8")
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+
+	client := &Client{Addr: listener.Addr().String(), Username: "alice", Password: "secret", Timeout: 5 * time.Second}
+	first, err := client.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := client.Dial("tcp", target.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("second session of alice accepted")
+	} else if !strings.Contains(err.Error(), replyText[2]) {
+		t.Errorf("got %v,want %q", err, replyText[2])
+	}
+	first.SetDeadline(time.Now().Add(5 * time.Second))
+	roundTrip(t, first, "done")
+	first.Close()
+
+	//the slot is released once the first session has ended
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := client.Dial("tcp", target.Addr().String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot of alice not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// associate opens a UDP ASSOCIATE for the UDP socket udp and returns the
+// control connection and the relay address
+func associate(t *testing.T, proxy string, udp *net.UDPConn) (net.Conn, *net.UDPAddr) {
+	client := &Client{Addr: proxy, Timeout: 5 * time.Second}
+	conn, err := client.handshake(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay, err := client.request(conn, CMD_UDP_ASSOCIATE, udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, &net.UDPAddr{IP: relay.IP, Port: relay.Port}
+}
+
+// TestUDPAssociateSameTarget relays datagrams of two clients to the same
+// target,each gets its own answers back
+func TestUDPAssociateSameTarget(t *testing.T) {
+	echo := listenUDPTest(t)
+	defer echo.Close()
+	go func() {
+		b := make([]byte, MAXUDPDATA)
+		for {
+			n, addr, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], addr)
+		}
+	}()
+	s := newTestServer(t)
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+
+	//both associations are open and have sent before either reads
+	target := echo.LocalAddr().(*net.UDPAddr)
+	names := []string{"first", "second"}
+	clients := make([]*net.UDPConn, len(names))
+	for i, name := range names {
+		clients[i] = listenUDPTest(t)
+		defer clients[i].Close()
+		conn, relay := associate(t, listener.Addr().String(), clients[i])
+		defer conn.Close()
+		if _, err := clients[i].WriteToUDP(AssembleHeader([]byte(name), target).Bytes(), relay); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, name := range names {
+		clients[i].SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, MAXUDPDATA)
+		n, _, err := clients[i].ReadFromUDP(b)
+		if err != nil {
+			t.Fatalf("%v client: %v", name, err)
+		}
+		if want := AssembleHeader([]byte(name), target).Bytes(); string(b[:n]) != string(want) {
+			t.Errorf("%v client got %q,want %q", name, b[:n], want)
+		}
+	}
+	if n := len(s.Sessions.Sessions()); n != 2 {
+		t.Errorf("%v sessions,want 2", n)
+	}
+}
@@ -0,0 +1,174 @@
+package socks5
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt ($5$ SHA-256 and $6$ SHA-512) as specified by Ulrich Drepper,
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+	cryptAlphabet         = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+// byte order of the final encoding,each entry is encoded into 4 characters
+var (
+	sha256CryptOrder = [][3]int{
+		{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+		{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29},
+	}
+	sha512CryptOrder = [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+)
+
+// verifySHACrypt reports whether password matches a $5$ or $6$ hash
+func verifySHACrypt(hashed, password string) bool {
+	var newHash func() hash.Hash
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		newHash = sha256.New
+	case strings.HasPrefix(hashed, "$6$"):
+		newHash = sha512.New
+	default:
+		return false
+	}
+	parts := strings.Split(hashed[3:], "$")
+	rounds, roundsCustom := shaCryptDefaultRounds, false
+	if len(parts) == 3 && strings.HasPrefix(parts[0], "rounds=") {
+		n, err := strconv.Atoi(strings.TrimPrefix(parts[0], "rounds="))
+		if err != nil {
+			return false
+		}
+		rounds, roundsCustom = n, true
+		parts = parts[1:]
+	}
+	if len(parts) != 2 {
+		return false
+	}
+	computed := shaCrypt(newHash, hashed[:3], []byte(password), []byte(parts[0]), rounds, roundsCustom)
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+}
+
+func shaCrypt(newHash func() hash.Hash, prefix string, key, salt []byte, rounds int, roundsCustom bool) string {
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+	if rounds < shaCryptMinRounds {
+		rounds = shaCryptMinRounds
+	}
+	if rounds > shaCryptMaxRounds {
+		rounds = shaCryptMaxRounds
+	}
+
+	//digest B
+	h := newHash()
+	h.Write(key)
+	h.Write(salt)
+	h.Write(key)
+	b := h.Sum(nil)
+	size := len(b)
+
+	//digest A
+	h.Reset()
+	h.Write(key)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(key)))
+	for n := len(key); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(key)
+		}
+	}
+	a := h.Sum(nil)
+
+	//byte sequence P
+	h.Reset()
+	for i := 0; i < len(key); i++ {
+		h.Write(key)
+	}
+	p := repeatBytes(h.Sum(nil), len(key))
+
+	//byte sequence S
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(a)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(a)
+		} else {
+			h.Write(p)
+		}
+		a = h.Sum(a[:0])
+	}
+
+	out := []byte(prefix)
+	if roundsCustom {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+	out = append(out, salt...)
+	out = append(out, '$')
+	order := sha256CryptOrder
+	if size == sha512.Size {
+		order = sha512CryptOrder
+	}
+	for _, o := range order {
+		out = appendCrypt64(out, uint(a[o[0]])<<16|uint(a[o[1]])<<8|uint(a[o[2]]), 4)
+	}
+	if size == sha512.Size {
+		out = appendCrypt64(out, uint(a[63]), 2)
+	} else {
+		out = appendCrypt64(out, uint(a[31])<<8|uint(a[30]), 3)
+	}
+	return string(out)
+}
+
+// repeatBytes repeats src until it is n bytes long
+func repeatBytes(src []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		rest := n - len(out)
+		if rest > len(src) {
+			rest = len(src)
+		}
+		out = append(out, src[:rest]...)
+	}
+	return out
+}
+
+func appendCrypt64(out []byte, w uint, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
@@ -1,8 +1,11 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	_ "net/http/pprof"
@@ -19,22 +22,58 @@ https://cloud.tencent.com/developer/article/1682604
 */
 
 const (
-	SOCKS5VERSION     = 5
-	MAXUDPDATA        = 1024 //MTU-IPHEADER-UDPHEADER
-	atypIPV4          = byte(1)
-	atypIPV6          = byte(4)
-	atypFQDN          = byte(3)
-	TCPRETRY          = 3
-	MAX_FRAGMENT_WAIT = 3 * time.Second
+	SOCKS5VERSION             = 5
+	MAXUDPDATA                = 1024 //MTU-IPHEADER-UDPHEADER
+	atypIPV4                  = byte(1)
+	atypIPV6                  = byte(4)
+	atypFQDN                  = byte(3)
+	AUTH_NONE                 = 0
+	AUTH_USERNAME_PASSWORD    = 2
+	CMD_CONNECT               = 1
+	CMD_BIND                  = 2
+	CMD_UDP_ASSOCIATE         = 3
+	MAX_FRAGMENT_WAIT         = 3 * time.Second
+	HANDSHAKE_TIMEOUT         = 10 * time.Second
+	CONNECT_TIMEOUT           = 10 * time.Second
+	BIND_TIMEOUT              = 60 * time.Second
+	USERS_FILE_CHECK_INTERVAL = 5 * time.Second
+	CERT_FILE_CHECK_INTERVAL  = time.Minute
+	ARGON2_MAX_MEMORY         = 1 << 18 //KiB,256MiB per login
+	ARGON2_MAX_TIME           = 16
+	ARGON2_MAX_THREADS        = 16
+	WEBHOOK_TIMEOUT           = 5 * time.Second
+	WEBHOOK_CACHE_TTL         = 60 * time.Second
+	WEBHOOK_CACHE_SIZE        = 4096
+	LDAP_TIMEOUT              = 5 * time.Second
+	LDAP_POOL_SIZE            = 4
+	AUTH_MAX_IP_FAILURES      = 5
+	AUTH_FAILURE_WINDOW       = 5 * time.Minute
+	AUTH_BAN_TIME             = time.Minute
+	AUTH_MAX_BAN_TIME         = time.Hour
+	AUTH_THROTTLE_SIZE        = 65536
+	UPSTREAM_MAX_FAILS        = 3
+	UPSTREAM_FAIL_TIMEOUT     = 30 * time.Second
+	UPSTREAM_PROBE_TIMEOUT    = 5 * time.Second
+	//a UDP relay is dropped once its remote side has been silent that long
+	UDP_SESSION_TIMEOUT = 60 * time.Second
 )
 
 var (
-	ERR_READ_USR_PWD = errors.New("ERR_READ_USR_PWD")
-	ERR_METHOD       = errors.New("ERR_METHOD")
-	ERR_VERSION      = errors.New("ERR_VERSION")
-	ERR_READ_FAILED  = errors.New("ERR_READ_FAILED")
-	ERR_ADDRESS_TYPE = errors.New("ERR_ADDRESS_TYPE")
-	ERR_AUTH_FAILED  = errors.New("ERR_AUTH_FAILED")
+	ERR_READ_USR_PWD   = errors.New("ERR_READ_USR_PWD")
+	ERR_METHOD         = errors.New("ERR_METHOD")
+	ERR_VERSION        = errors.New("ERR_VERSION")
+	ERR_READ_FAILED    = errors.New("ERR_READ_FAILED")
+	ERR_ADDRESS_TYPE   = errors.New("ERR_ADDRESS_TYPE")
+	ERR_AUTH_BANNED    = errors.New("ERR_AUTH_BANNED")
+	ERR_AUTH_FAILED    = errors.New("ERR_AUTH_FAILED")
+	ERR_UDP_NO_ASSOC   = errors.New("ERR_UDP_NO_ASSOC")
+	ERR_RULESET        = errors.New("ERR_RULESET")
+	ERR_EGRESS_BLOCKED = errors.New("ERR_EGRESS_BLOCKED")
+	ERR_ROUTE_BLOCKED  = errors.New("ERR_ROUTE_BLOCKED")
+	//the server refused the credentials of a Client
+	ERR_CLIENT_AUTH = errors.New("ERR_CLIENT_AUTH")
+	//the user backend could not decide,e.g. LDAP or the webhook is down
+	ERR_AUTH_BACKEND = errors.New("ERR_AUTH_BACKEND")
 )
 var ErrMethod = byte(255)
 
@@ -69,50 +108,128 @@ func (s *TCPConn) authHandle(conn net.Conn) error {
 		methods = append(methods, int(method[0]))
 	}
 
-	//loop and specify auth method
-	for _, v := range methods {
-		//USERNAME/PASSWORD
-		if v == 2 {
-			log.Printf("[ID:%v]AUTHENTICATION:USERNAME/PASSWORD  <- %v\n", s.ID(), conn.RemoteAddr())
-			conn.Write([]byte{5, 2})
-
-			user, pwd, err := s.resolveUserPwd(conn)
-			if user == "" || pwd == "" {
-				return err
-			}
-
-			if !s.server.Conf.Authenticate(user, pwd) {
-				return ERR_AUTH_FAILED
-			}
+	//pick the method:no auth for clients with a verified certificate,otherwise
+	//username/password whenever the server requires it,clients that don't
+	//offer it are refused
+	hasAuth := s.server.Conf.HasAuth()
+	req := AuthRequest{Client: conn.RemoteAddr(), Listener: conn.LocalAddr()}
+	switch {
+	//CLIENT CERTIFICATE,it stands in for the username/password
+	case s.certIdentity != nil && containsInt(methods, AUTH_NONE):
+		log.Printf("[ID:%v]AUTHENTICATION:CLIENT CERTIFICATE %v <- %v\n", s.ID(), s.certIdentity.User, conn.RemoteAddr())
+		req.Method, req.Username = AUTH_NONE, s.certIdentity.User
+		if err := s.server.hookAuth(req, s.certIdentity, nil); err != nil {
+			log.Printf("[ID:%v]CLIENT %v REFUSED BY HOOK: %v\n", s.ID(), conn.RemoteAddr(), err)
+			conn.Write([]byte{5, ErrMethod})
+			return ERR_AUTH_FAILED
+		}
+		s.identity = s.certIdentity
+		s.user, s.policy = s.identity.User, s.identity.Policy
+		conn.Write([]byte{5, AUTH_NONE})
+	//USERNAME/PASSWORD
+	case containsInt(methods, AUTH_USERNAME_PASSWORD) && (hasAuth || !containsInt(methods, AUTH_NONE)):
+		log.Printf("[ID:%v]AUTHENTICATION:USERNAME/PASSWORD  <- %v\n", s.ID(), conn.RemoteAddr())
+		conn.Write([]byte{5, AUTH_USERNAME_PASSWORD})
 
-			/*+----+--------+
-			|VER | STATUS |
-			+----+--------+
-			| 1 | 1 |
-			+----+--------+*/
-			conn.Write([]byte{1, 0})
-			log.Printf("[ID:%v]REPLY USERNAME/PASSWORD METHOD OK -> %v\n", s.ID(), conn.RemoteAddr())
-			break
+		user, pwd, err := s.resolveUserPwd(conn)
+		if user == "" || pwd == "" {
+			conn.Write([]byte{1, 1})
+			return err
 		}
-		//NO AUTH
-		if v == 0 {
-			if s.server.Conf.HasAuth() {
-				conn.Write([]byte{5, 2})
+		clientIP, _ := addrIPPort(conn.RemoteAddr())
+		throttle := s.server.AuthThrottle
+		if throttle.Banned(clientIP, user) {
+			conn.Write([]byte{1, 1})
+			log.Printf("[ID:%v]LOGIN OF %v FROM %v REFUSED,BANNED\n", s.ID(), user, conn.RemoteAddr())
+			return ERR_AUTH_BANNED
+		}
+		req.Method, req.Username, req.Password = AUTH_USERNAME_PASSWORD, user, pwd
+		if err := s.authenticate(req); err != nil {
+			//only wrong credentials count,an outage of the backend must not ban anybody
+			if err == ERR_AUTH_FAILED {
+				throttle.Failure(clientIP, user)
 			}
-			log.Printf("[ID:%v]AUTHENTICATION:NO AUTHEN <- %v\n", s.ID(), conn.RemoteAddr())
-			conn.Write([]byte{5, 0})
-			log.Printf("[ID:%v]REPLY NO AUTHEN METHOD OK -> %v\n", s.ID(), conn.RemoteAddr())
-			break
+			//RFC 1929 has no status for server failures,any non-zero one is a failure
+			conn.Write([]byte{1, 1})
+			return err
+		}
+		throttle.Success(user)
+
+		/*+----+--------+
+		|VER | STATUS |
+		+----+--------+
+		| 1 | 1 |
+		+----+--------+*/
+		conn.Write([]byte{1, 0})
+		log.Printf("[ID:%v]REPLY USERNAME/PASSWORD METHOD OK -> %v\n", s.ID(), conn.RemoteAddr())
+	//NO AUTH
+	case containsInt(methods, AUTH_NONE) && !hasAuth:
+		log.Printf("[ID:%v]AUTHENTICATION:NO AUTHEN <- %v\n", s.ID(), conn.RemoteAddr())
+		req.Method = AUTH_NONE
+		if err := s.authenticate(req); err != nil {
+			conn.Write([]byte{5, ErrMethod})
+			return err
 		}
+		conn.Write([]byte{5, AUTH_NONE})
+		log.Printf("[ID:%v]REPLY NO AUTHEN METHOD OK -> %v\n", s.ID(), conn.RemoteAddr())
+	default:
 		conn.Write([]byte{5, ErrMethod})
 		return ERR_METHOD
 	}
 	return nil
 }
 
+// authenticate asks the Config about req and takes over the identity it returns.
+// It returns ERR_AUTH_FAILED for refused credentials and ERR_AUTH_BACKEND if
+// the Config failed to check them.
+func (s *TCPConn) authenticate(req AuthRequest) error {
+	ctx := context.Background()
+	if s.server.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.server.HandshakeTimeout)
+		defer cancel()
+	}
+	identity, err := s.server.Conf.Authenticate(ctx, req)
+	if err == nil && identity == nil {
+		err = ERR_AUTH_FAILED
+	}
+	if err != nil {
+		s.server.hookAuth(req, nil, err)
+		if err != ERR_AUTH_FAILED {
+			log.Printf("[ID:%v]authentication of %v failed: %v\n", s.ID(), req.Client, err)
+			return ERR_AUTH_BACKEND
+		}
+		return err
+	}
+	if err := s.server.hookAuth(req, identity, nil); err != nil {
+		log.Printf("[ID:%v]CLIENT %v REFUSED BY HOOK: %v\n", s.ID(), req.Client, err)
+		return ERR_AUTH_FAILED
+	}
+	s.identity = identity
+	s.user, s.policy = identity.User, identity.Policy
+	return nil
+}
+
 func (s *TCPConn) ServConn(conn net.Conn) {
 	defer conn.Close()
 
+	//the whole handshake must finish in time,the deadline is lifted once the request is read
+	if s.server.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.server.HandshakeTimeout))
+	}
+
+	if err := s.server.hookAccept(conn); err != nil {
+		log.Printf("[ID:%v]CLIENT %v REFUSED BY HOOK: %v\n", s.ID(), conn.RemoteAddr(), err)
+		return
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := s.tlsHandshake(tlsConn); err != nil {
+			log.Printf("[ID:%v]TLS HANDSHAKE WITH %v FAILED: %v\n", s.ID(), conn.RemoteAddr(), err)
+			return
+		}
+	}
+
 	//version
 	verByte := make([]byte, 1)
 	_, err := conn.Read(verByte)
@@ -162,9 +279,11 @@ func (s *TCPConn) ServConn(conn net.Conn) {
 	_, cmd, atyp := int(headBytes[0]), int(headBytes[1]), int(headBytes[3])
 
 	request := &TCPRequest{
-		clientAddr: conn.RemoteAddr().(*net.TCPAddr),
+		clientAddr: tcpAddr(conn.RemoteAddr()),
 		atyp:       atyp,
 		cmd:        cmd,
+		user:       s.user,
+		policy:     s.policy,
 	}
 
 	//dst address
@@ -173,29 +292,89 @@ func (s *TCPConn) ServConn(conn net.Conn) {
 		log.Printf("[ID:%v]%v", s.ID(), err)
 		return
 	}
+	s.request = request
+
+	//hooks may deny the request or send it elsewhere
+	hookReq := &HookRequest{
+		Command:  cmd,
+		User:     s.user,
+		Identity: s.identity,
+		Client:   conn.RemoteAddr(),
+		Target:   request.hostport(),
+	}
+	if err := s.server.hookRequest(hookReq); err != nil {
+		log.Printf("[ID:%v]REQUEST %v DENIED BY HOOK: %v\n", s.ID(), hookReq.Target, err)
+		s.sendReply(conn, nil, 0, 2)
+		return
+	}
+	if hookReq.Target != request.hostport() {
+		log.Printf("[ID:%v]REQUEST %v REWRITTEN TO %v\n", s.ID(), request.hostport(), hookReq.Target)
+		request.rewritten = false
+	}
+	if err := s.retarget(request, hookReq.Target); err != nil {
+		log.Printf("[ID:%v]%v", s.ID(), err)
+		s.sendReply(conn, nil, 0, 4)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("ACTIVE SESSIONS:%v\n", s.server.Sessions.Len())
+
+	//per-user policy
+	if !request.policy.allowCommand(cmd) {
+		log.Printf("[ID:%v]command %v not allowed for user %v\n", s.ID(), cmd, request.user)
+		s.sendReply(conn, nil, 0, 2)
+		return
+	}
+	if request.policy != nil {
+		if !s.server.Sessions.acquireUser(request.user, request.policy.MaxSessions) {
+			log.Printf("[ID:%v]user %v reached max sessions %v\n", s.ID(), request.user, request.policy.MaxSessions)
+			s.sendReply(conn, nil, 0, 2)
+			return
+		}
+		defer s.server.Sessions.releaseUser(request.user)
+	}
 
-	log.Printf("TOTAL TCP CONN:%v  UDP CONN:%v\n", len(s.server.TCPRequestMap), len(s.server.UDPRequestMap))
+	//destination access control,UDP ASSOCIATE is checked per datagram
+	if cmd != CMD_UDP_ASSOCIATE && !s.allowedByRules(request) {
+		s.sendReply(conn, nil, 0, 2)
+		return
+	}
 
 	//command
 	switch cmd {
-	case 1:
+	case CMD_CONNECT:
 		log.Printf("[ID:%v]CMD: CONNECT <- %v\n", s.ID(), conn.RemoteAddr())
 		s.HandleCONNECT(conn, request)
-	case 2:
+	case CMD_BIND:
 		log.Printf("[ID:%v]CMD: BIND <- %v\n", s.ID(), conn.RemoteAddr())
 		s.HandleBIND(conn, request)
-	case 3:
+	case CMD_UDP_ASSOCIATE:
 		log.Printf("[ID:%v]CMD: UDP ASSOCIATE <- %v\n", s.ID(), conn.RemoteAddr())
 		log.Printf("[ID:%v]CLIENT EXPECT IP:%v  PORT:%v\n", s.ID(), request.TargetAddr.IP.String(), request.TargetAddr.Port)
-		s.sendReply(conn, conn.LocalAddr().(*net.TCPAddr).IP, s.server.udpConn.LocalAddr().(*net.UDPAddr).Port, 0)
-		log.Printf("[ID:%v][UDP] REPLY BIND PORT: %v \n", s.ID(), s.server.udpConn.LocalAddr().(*net.UDPAddr).Port)
-		for {
-			conn.SetReadDeadline(time.Time{})
-			if _, err := conn.Read([]byte{}); err == io.EOF {
-				return
-			} else {
-				time.Sleep(time.Second * 10)
-			}
+		//datagrams are only relayed for the address announced by the client,falling back to its TCP address
+		udpClient := &net.UDPAddr{IP: request.TargetAddr.IP, Port: request.TargetAddr.Port}
+		if udpClient.IP.IsUnspecified() {
+			udpClient.IP = request.clientAddr.IP
 		}
+		session := s.server.Sessions.Add(&Session{
+			ID:         s.id,
+			Command:    cmd,
+			Client:     conn.RemoteAddr(),
+			User:       s.user,
+			Identity:   s.identity,
+			policy:     s.policy,
+			clientConn: conn,
+			udpClient:  udpClient,
+		})
+		s.sendReply(conn, tcpAddr(conn.LocalAddr()).IP, s.server.udpConn.LocalAddr().(*net.UDPAddr).Port, 0)
+		log.Printf("[ID:%v][UDP] REPLY BIND PORT: %v \n", s.ID(), s.server.udpConn.LocalAddr().(*net.UDPAddr).Port)
+		s.server.hookConnected(session)
+		//the association lasts as long as the TCP connection
+		io.Copy(ioutil.Discard, conn)
+		s.server.Sessions.Remove(session.ID)
+		s.server.closeUDPRequests(session)
+		s.server.hookClose(session)
+		log.Printf("[ID:%v][UDP]ASSOCIATE CLOSED client sent %v bytes,remote sent %v bytes\n", s.ID(), session.BytesSent(), session.BytesReceived())
 	}
 }
@@ -0,0 +1,174 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server without authentication that may reach the
+// loopback network,where the tests run their targets
+func newTestServer(t *testing.T) *Server {
+	s := NewSocks5Server(&defConfig{Port: "0", defAuth: &defAuth{}})
+	s.Egress.Allowed = mustParseCIDRs("127.0.0.0/8", "::1/128")
+	return s
+}
+
+func listenTest(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+// halfCloseTarget reads until the client half closes,then answers with
+// "reply:" and what it read,so it only answers if the half close arrives
+func halfCloseTarget(t *testing.T) net.Listener {
+	listener := listenTest(t)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				data, err := ioutil.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("reply:"), data...))
+			}()
+		}
+	}()
+	return listener
+}
+
+// roundTrip sends msg on conn,half closes it and returns the answer
+func roundTrip(t *testing.T, conn net.Conn, msg string) string {
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	cw, ok := conn.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("%T can't half close", conn)
+	}
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+// TestServConnPipe runs a CONNECT over in-memory connections,whose addresses
+// are neither TCP nor UDP,on both the client and the target side
+func TestServConnPipe(t *testing.T) {
+	s := newTestServer(t)
+	dialed := make(chan string, 1)
+	s.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed <- addr
+		conn, target := net.Pipe()
+		go func() {
+			target.Write([]byte("hello from the pipe"))
+			target.Close()
+		}()
+		return conn, nil
+	})
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&TCPConn{server: s, conn: server}).ServConn(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := client.Write([]byte{SOCKS5VERSION, 1, AUTH_NONE}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil || method[1] != AUTH_NONE {
+		t.Fatalf("method %v: %v", method, err)
+	}
+	if _, err := client.Write([]byte{SOCKS5VERSION, CMD_CONNECT, 0, atypIPV4, 192, 0, 2, 1, 0, 80}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply); err != nil {
+		t.Fatal(err)
+	}
+	//the bound address of a pipe is reported as 0.0.0.0:0
+	if want := []byte{SOCKS5VERSION, 0, 0, atypIPV4, 0, 0, 0, 0, 0, 0}; !bytes.Equal(reply, want) {
+		t.Errorf("reply %v,want %v", reply, want)
+	}
+	if addr := <-dialed; addr != "192.0.2.1:80" {
+		t.Errorf("dialed %v", addr)
+	}
+	data, err := ioutil.ReadAll(client)
+	if err != nil || string(data) != "hello from the pipe" {
+		t.Errorf("relayed %q,%v", data, err)
+	}
+}
+
+type authFunc func(ctx context.Context, req AuthRequest) (*Identity, error)
+
+func (f authFunc) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	return f(ctx, req)
+}
+
+// TestAuthBackendErrors checks that only refused credentials count towards a
+// ban,not a user backend that is down
+func TestAuthBackendErrors(t *testing.T) {
+	backendDown := errors.New("ldap: connection refused")
+	config := &defConfig{Port: "0", defAuth: &defAuth{}}
+	config.SetAuthenticator(authFunc(func(ctx context.Context, req AuthRequest) (*Identity, error) {
+		if req.Username == "outage" {
+			return nil, backendDown
+		}
+		return nil, ERR_AUTH_FAILED
+	}))
+	s := NewSocks5Server(config)
+	var hookErrs []error
+	s.AddHooks(&Hooks{OnAuth: func(req AuthRequest, identity *Identity, err error) error {
+		hookErrs = append(hookErrs, err)
+		return nil
+	}})
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+	loopback := net.ParseIP("127.0.0.1")
+
+	login := func(user string) {
+		client := &Client{Addr: listener.Addr().String(), Username: user, Password: "secret", Timeout: 5 * time.Second}
+		if conn, err := client.Dial("tcp", "192.0.2.1:80"); err == nil {
+			conn.Close()
+			t.Fatalf("login of %v succeeded", user)
+		}
+	}
+	for i := 0; i < 2*AUTH_MAX_IP_FAILURES; i++ {
+		login("outage")
+	}
+	if s.AuthThrottle.Banned(loopback, "") {
+		t.Fatal("client banned for failures of the backend")
+	}
+	if len(hookErrs) == 0 || hookErrs[0] != backendDown {
+		t.Errorf("OnAuth got %v,want the error of the backend", hookErrs)
+	}
+	for i := 0; i < AUTH_MAX_IP_FAILURES; i++ {
+		login("mallory")
+	}
+	if !s.AuthThrottle.Banned(loopback, "") {
+		t.Error("client not banned for wrong passwords")
+	}
+}
@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// EgressSource selects where outgoing connections leave the host,for hosts
+// with many addresses or uplinks.It can be set for the server,per user and
+// per outbound,the most specific one applies.
+type EgressSource struct {
+	// IP is the source address
+	IP net.IP
+	// Interface binds sockets to a network interface (SO_BINDTODEVICE on
+	// Linux,elsewhere only its address is used).Without IP one of the
+	// interface's addresses is the source.
+	Interface string
+	// MatchListener uses the address of the listener the client connected to
+	// as the source,falling back to IP and Interface when that is a loopback
+	// or wildcard address or of the other IP family than the destination.
+	MatchListener bool
+}
+
+// ParseEgressSource parses comma separated settings,a bare address is the IP:
+//
+//	192.0.2.10
+//	interface=eth1
+//	ip=192.0.2.10,interface=eth1
+//	listener,ip=192.0.2.10
+func ParseEgressSource(text string) (*EgressSource, error) {
+	e := &EgressSource{}
+	for _, item := range strings.Split(text, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if strings.ToLower(item) == "listener" {
+			e.MatchListener = true
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) == 1 {
+			kv = []string{"ip", item}
+		}
+		switch strings.ToLower(kv[0]) {
+		case "ip":
+			if e.IP = net.ParseIP(kv[1]); e.IP == nil {
+				return nil, fmt.Errorf("invalid source address %q", kv[1])
+			}
+		case "interface":
+			e.Interface = kv[1]
+		default:
+			return nil, fmt.Errorf("unknown source setting %q", kv[0])
+		}
+	}
+	if e.IP == nil && e.Interface == "" && !e.MatchListener {
+		return nil, fmt.Errorf("empty source %q", text)
+	}
+	return e, nil
+}
+
+// localIP returns the source address for a connection to target accepted on
+// listener,either may be nil,and nil if the system should choose
+func (e *EgressSource) localIP(listener, target net.IP) (net.IP, error) {
+	if e == nil {
+		return nil, nil
+	}
+	if e.MatchListener && listener != nil && !listener.IsUnspecified() && !listener.IsLoopback() {
+		if target == nil || (listener.To4() != nil) == (target.To4() != nil) {
+			return listener, nil
+		}
+	}
+	if e.IP != nil {
+		return e.IP, nil
+	}
+	if e.Interface != "" {
+		return interfaceIP(e.Interface, target)
+	}
+	return nil, nil
+}
+
+// apply sets the source of d for a connection to target accepted on listener
+func (e *EgressSource) apply(d *net.Dialer, network string, listener, target net.IP) error {
+	ip, err := e.localIP(listener, target)
+	if err != nil {
+		return err
+	}
+	if ip != nil {
+		if strings.HasPrefix(network, "udp") {
+			d.LocalAddr = &net.UDPAddr{IP: ip}
+		} else {
+			d.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	if e != nil && e.Interface != "" {
+		device := e.Interface
+		d.Control = chainControl(d.Control, func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, device)
+		})
+	}
+	return nil
+}
+
+// chainControl runs the net.Dialer Control functions first and then next
+func chainControl(first, next func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if first == nil || next == nil {
+		if first == nil {
+			return next
+		}
+		return first
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if err := first(network, address, c); err != nil {
+			return err
+		}
+		return next(network, address, c)
+	}
+}
+
+// interfaceIP returns an address of the interface to dial target from,one of
+// the same family is preferred,IPv4 if target is nil
+func interfaceIP(name string, target net.IP) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	wantV4 := target == nil || target.To4() != nil
+	var fallback net.IP
+	for _, a := range addrs {
+		n, ok := a.(*net.IPNet)
+		if !ok || n.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if (n.IP.To4() != nil) == wantV4 {
+			return n.IP, nil
+		}
+		if fallback == nil {
+			fallback = n.IP
+		}
+	}
+	if fallback == nil {
+		return nil, fmt.Errorf("interface %v has no address", name)
+	}
+	return fallback, nil
+}
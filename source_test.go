@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseEgressSource(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    EgressSource
+		wantErr bool
+	}{
+		{"192.0.2.10", EgressSource{IP: net.ParseIP("192.0.2.10")}, false},
+		{"interface=eth1", EgressSource{Interface: "eth1"}, false},
+		{"ip=2001:db8::10, interface=eth1", EgressSource{IP: net.ParseIP("2001:db8::10"), Interface: "eth1"}, false},
+		{"LISTENER,ip=192.0.2.10", EgressSource{IP: net.ParseIP("192.0.2.10"), MatchListener: true}, false},
+		{"", EgressSource{}, true},
+		{",", EgressSource{}, true},
+		{"192.0.2.300", EgressSource{}, true},
+		{"ip=eth1", EgressSource{}, true},
+		{"port=80", EgressSource{}, true},
+	}
+	for _, tt := range tests {
+		e, err := ParseEgressSource(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseEgressSource(%q) error = %v,want error %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (!e.IP.Equal(tt.want.IP) || e.Interface != tt.want.Interface || e.MatchListener != tt.want.MatchListener) {
+			t.Errorf("ParseEgressSource(%q) = %+v,want %+v", tt.text, e, tt.want)
+		}
+	}
+}
+
+func TestEgressSourceLocalIP(t *testing.T) {
+	v4, v6 := net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")
+	listener4, listener6 := net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8:1::1")
+	target4, target6 := net.ParseIP("203.0.113.1"), net.ParseIP("2001:db8:2::1")
+	match := &EgressSource{MatchListener: true, IP: v4}
+	tests := []struct {
+		name             string
+		source           *EgressSource
+		listener, target net.IP
+		want             net.IP
+	}{
+		{"nil lets the system choose", nil, listener4, target4, nil},
+		{"fixed address", &EgressSource{IP: v6}, listener4, target6, v6},
+		{"listener of the same family", match, listener4, target4, listener4},
+		{"ipv6 listener", match, listener6, target6, listener6},
+		{"listener of the other family", match, listener6, target4, v4},
+		{"unknown target", match, listener6, nil, listener6},
+		{"loopback listener", match, net.ParseIP("127.0.0.1"), target4, v4},
+		{"wildcard listener", match, net.IPv4zero, target4, v4},
+		{"no listener", match, nil, target4, v4},
+		{"no fallback", &EgressSource{MatchListener: true}, listener6, target4, nil},
+	}
+	for _, tt := range tests {
+		got, err := tt.source.localIP(tt.listener, tt.target)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("%v: localIP = %v,%v,want %v", tt.name, got, err, tt.want)
+		}
+	}
+	if _, err := (&EgressSource{Interface: "no-such-interface0"}).localIP(nil, nil); err == nil {
+		t.Error("a missing interface must fail")
+	}
+}
+
+// TestEgressSourceInterface picks addresses of the loopback interface by the
+// family of the target
+func TestEgressSourceInterface(t *testing.T) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			lo = iface.Name
+			break
+		}
+	}
+	if lo == "" {
+		t.Skip("no loopback interface")
+	}
+	source := &EgressSource{Interface: lo}
+	ip, err := source.localIP(nil, net.ParseIP("127.0.0.2"))
+	if err != nil || ip.To4() == nil {
+		t.Errorf("ipv4 target: source %v,%v", ip, err)
+	}
+	if ip, err := source.localIP(nil, net.IPv6loopback); err != nil || (ip.To4() == nil) != hasIPv6(lo) {
+		t.Errorf("ipv6 target: source %v,%v", ip, err)
+	}
+
+	d := &net.Dialer{}
+	if err := source.apply(d, "udp", nil, net.ParseIP("127.0.0.2")); err != nil {
+		t.Fatal(err)
+	}
+	if addr, ok := d.LocalAddr.(*net.UDPAddr); !ok || !addr.IP.Equal(ip) {
+		t.Errorf("udp local address %v,want %v", d.LocalAddr, ip)
+	}
+	if d.Control == nil {
+		t.Error("the interface isn't bound")
+	}
+	d = &net.Dialer{}
+	if err := (&EgressSource{IP: net.ParseIP("127.0.0.1")}).apply(d, "tcp", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.LocalAddr.(*net.TCPAddr); !ok || d.Control != nil {
+		t.Errorf("tcp dialer %+v", d)
+	}
+}
+
+func hasIPv6(name string) bool {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return false
+	}
+	addrs, _ := iface.Addrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.To4() == nil && !n.IP.IsLinkLocalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestChainControl(t *testing.T) {
+	var calls []string
+	control := func(name string, err error) func(network, address string, c syscall.RawConn) error {
+		return func(network, address string, c syscall.RawConn) error {
+			calls = append(calls, name)
+			return err
+		}
+	}
+	if chainControl(nil, nil) != nil {
+		t.Error("chain of nothing isn't nil")
+	}
+	chainControl(control("first", nil), nil)("tcp", "", nil)
+	chainControl(nil, control("next", nil))("tcp", "", nil)
+	chainControl(control("first", nil), control("next", nil))("tcp", "", nil)
+	stop := errors.New("stop")
+	if err := chainControl(control("failing", stop), control("next", nil))("tcp", "", nil); err != stop {
+		t.Errorf("got %v,want the first error", err)
+	}
+	if got := strings.Join(calls, ","); got != "first,next,first,next,failing" {
+		t.Errorf("calls %v", got)
+	}
+
+	//the egress guard runs first,a refused address never gets to the source's Control
+	target := listenTest(t)
+	defer target.Close()
+	guard := NewEgressGuard()
+	d := &net.Dialer{Control: chainControl(guard.control, control("source", nil))}
+	calls = nil
+	if conn, err := d.Dial("tcp", target.Addr().String()); !errors.Is(err, ERR_EGRESS_BLOCKED) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Errorf("got %v,want %v", err, ERR_EGRESS_BLOCKED)
+	}
+	if len(calls) != 0 {
+		t.Errorf("controls after the guard ran: %v", calls)
+	}
+	guard.Allowed = mustParseCIDRs("127.0.0.0/8")
+	conn, err := d.Dial("tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if len(calls) != 1 {
+		t.Errorf("source's Control ran %v times", len(calls))
+	}
+}
@@ -2,14 +2,15 @@ package socks5
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"strings"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/pkg/errors"
 )
 
 const (
@@ -27,17 +28,24 @@ func (s *TCPConn) HandleBIND(conn net.Conn, req *TCPRequest) {
 		}
 	}
 
-	//launch listener on proxy server side
-	listener, err := net.Listen("tcp", ":0")
+	//launch listener on the interface facing the client,so the reply carries a reachable address
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: tcpAddr(conn.LocalAddr()).IP})
 	if err != nil {
+		log.Printf("[ID:%v]BIND listen failed: %v\n", s.ID(), err)
+		s.sendReply(conn, nil, 0, 1)
 		return
 	}
+	bindAddr := listener.Addr().(*net.TCPAddr)
 	//first reply,client get host side listener address and to notify dest server to connect to proxy server side listener
-	s.sendReply(conn, listener.Addr().(*net.TCPAddr).IP, listener.Addr().(*net.TCPAddr).Port, 0)
+	s.sendReply(conn, bindAddr.IP, bindAddr.Port, 0)
+	log.Printf("[ID:%v]BIND LISTENING ON %v,EXPECT PEER %v\n", s.ID(), bindAddr, req.TargetAddr.IP)
 	//server -> client
 	//dest server connect to host
-	targetConn, err := listener.Accept()
+	targetConn, err := s.acceptBIND(listener, req)
+	listener.Close()
 	if err != nil {
+		log.Printf("[ID:%v]BIND accept failed: %v\n", s.ID(), err)
+		s.sendReply(conn, nil, 0, 1)
 		return
 	}
 	// 设置目标服务器连接选项
@@ -48,15 +56,73 @@ func (s *TCPConn) HandleBIND(conn net.Conn, req *TCPRequest) {
 	}
 
 	//sec reply
-	s.sendReply(conn, targetConn.RemoteAddr().(*net.TCPAddr).IP, targetConn.RemoteAddr().(*net.TCPAddr).Port, 0)
-	s.RegisterTCPRequest(req)
-	closeChan := make(chan error, 2)
+	peer := tcpAddr(targetConn.RemoteAddr())
+	s.sendReply(conn, peer.IP, peer.Port, 0)
+	req.TargetConn = targetConn
+	session := s.registerSession(conn, req)
+	defer s.server.Sessions.Remove(session.ID)
+	s.server.hookConnected(session)
 	//transport data within client and dest
-	s.TCPTransport(conn, targetConn, closeChan)
-	for range [2]struct{}{} {
-		<-closeChan
+	sent, received := s.TCPTransport(conn, targetConn, session)
+	s.server.hookClose(session)
+	log.Printf("[ID:%v][TCP]BIND CLOSED client sent %v bytes,remote sent %v bytes\n", s.ID(), sent, received)
+}
+
+// allowedByRules checks a CONNECT/BIND request against Server.Rules
+func (s *TCPConn) allowedByRules(req *TCPRequest) bool {
+	allowed := req.policy.evaluate(s.server.Rules, s.ruleRequest(req))
+	if !allowed {
+		log.Printf("[ID:%v]%v %v %v\n", s.ID(), ERR_RULESET, req.domain, req.TargetAddr)
+	}
+	return allowed
+}
+
+// ruleRequest describes req for rules and routes
+func (s *TCPConn) ruleRequest(req *TCPRequest) *RuleRequest {
+	return &RuleRequest{
+		Command: req.cmd,
+		Domain:  req.domain,
+		IPs:     req.targetIPs,
+		Port:    req.TargetAddr.Port,
+		Client:  req.clientAddr.IP,
+		User:    req.user,
+	}
+}
+
+// registerSession adds the CONNECT/BIND session of this connection to the server registry
+func (s *TCPConn) registerSession(conn net.Conn, req *TCPRequest) *Session {
+	return s.server.Sessions.Add(&Session{
+		ID:         s.id,
+		Command:    req.cmd,
+		Client:     conn.RemoteAddr(),
+		Target:     req.TargetConn.RemoteAddr(),
+		User:       req.user,
+		Identity:   s.identity,
+		policy:     req.policy,
+		clientConn: conn,
+		targetConn: req.TargetConn,
+	})
+}
+
+// acceptBIND waits for the inbound connection of a BIND request.Unless
+// Server.BindAllowAnyPeer is set,only connections from the DST.ADDR given by
+// the client are taken,others are dropped.The wait is bounded by Server.BindTimeout.
+func (s *TCPConn) acceptBIND(listener *net.TCPListener, req *TCPRequest) (net.Conn, error) {
+	if s.server.BindTimeout > 0 {
+		listener.SetDeadline(time.Now().Add(s.server.BindTimeout))
+	}
+	for {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		peer := conn.RemoteAddr().(*net.TCPAddr)
+		if s.server.BindAllowAnyPeer || req.TargetAddr.IP.IsUnspecified() || peer.IP.Equal(req.TargetAddr.IP) {
+			return conn, nil
+		}
+		log.Printf("[ID:%v]BIND rejected unexpected peer %v\n", s.ID(), peer)
+		conn.Close()
 	}
-	s.DelTCPRequest(req.TargetAddr.String())
 }
 
 // support for CMD CONNECT
@@ -68,11 +134,20 @@ func (s *TCPConn) HandleCONNECT(conn net.Conn, req *TCPRequest) {
 		}
 	}
 
-	targetConn, err := s.DialTCP(req.TargetAddr)
+	targetConn, err := s.dialTarget(req)
 	if err != nil {
-		s.sendReply(conn, req.TargetAddr.IP, req.TargetAddr.Port, 3)
+		log.Printf("[ID:%v]dial %v %v failed: %v\n", s.ID(), req.domain, req.TargetAddr, err)
+		rep := 3
+		if errors.Is(err, ERR_EGRESS_BLOCKED) || errors.Is(err, ERR_ROUTE_BLOCKED) || err == ERR_RULESET {
+			rep = 2
+		}
+		s.sendReply(conn, req.TargetAddr.IP, req.TargetAddr.Port, rep)
 		return
 	}
+	//through an upstream proxy the remote address may be an unresolved name
+	if addr, ok := targetConn.RemoteAddr().(*net.TCPAddr); ok {
+		req.TargetAddr = addr
+	}
 	// 设置目标服务器连接选项
 	if tcpConn, ok := targetConn.(*net.TCPConn); ok {
 		if err := setTCPOptions(tcpConn); err != nil {
@@ -81,70 +156,136 @@ func (s *TCPConn) HandleCONNECT(conn net.Conn, req *TCPRequest) {
 	}
 
 	req.TargetConn = targetConn
-	s.RegisterTCPRequest(req)
-	closeChan := make(chan error, 2)
-	//asynchronous transport launch
-	s.TCPTransport(conn, targetConn, closeChan)
-	//reply
-	s.sendReply(conn, targetConn.LocalAddr().(*net.TCPAddr).IP, targetConn.LocalAddr().(*net.TCPAddr).Port, 0)
-	//error handling
-	for range [2]struct{}{} {
-		<-closeChan
-	}
-	s.DelTCPRequest(req.TargetAddr.String())
+	session := s.registerSession(conn, req)
+	defer s.server.Sessions.Remove(session.ID)
+	//reply before any target data reaches the client
+	//0.0.0.0:0 if the dialer's connection has no TCP address,e.g. an in-memory one
+	bound := tcpAddr(targetConn.LocalAddr())
+	s.sendReply(conn, bound.IP, bound.Port, 0)
+	s.server.hookConnected(session)
+	sent, received := s.TCPTransport(conn, targetConn, session)
+	s.server.hookClose(session)
+	log.Printf("[ID:%v][TCP]CONNECT CLOSED client sent %v bytes,remote sent %v bytes\n", s.ID(), sent, received)
 }
 
-// Concurrently TCP traffic transport with 3 reading timeout
-func (s *TCPConn) TCPTransport(clientConn, remoteConn net.Conn, closeChan chan error) {
-	go func() {
-		limit := TCPRETRY
-		remoteConn.SetReadDeadline(time.Time{})
-		for {
-			n, err := copyBuffer(clientConn, remoteConn)
-			if err != nil {
-				if errors.Is(err, io.EOF) ||
-					strings.Contains(err.Error(), "timeout") ||
-					strings.Contains(err.Error(), "closed") ||
-					limit <= 0 {
-					closeChan <- err
-					return
-				}
-				time.Sleep(time.Second * 5)
-				limit--
-				continue
-			}
-			if n == 0 {
-				time.Sleep(time.Second * 3)
-				continue
-			}
-			log.Printf("[ID:%v][TCP]remote:%v send %v bytes -> client:%v\n", s.ID(), remoteConn.RemoteAddr(), n, clientConn.RemoteAddr())
+// dialTarget connects to the destination of a CONNECT request through the
+// outbound Server.Router picks for it
+func (s *TCPConn) dialTarget(req *TCPRequest) (net.Conn, error) {
+	out := s.server.Router.Route(s.ruleRequest(req))
+	if out == nil {
+		return s.dialChecked(req, func(hostport string, ip net.IP) (net.Conn, error) {
+			return s.DialHost(hostport)
+		})
+	}
+	log.Printf("[ID:%v]ROUTE %v -> OUTBOUND %v\n", s.ID(), req.hostport(), out.Name)
+	if out.Type == OutboundPool {
+		return out.Pool.dial(req.clientAddr.IP, func(member *Outbound) (net.Conn, error) {
+			log.Printf("[ID:%v]POOL %v -> UPSTREAM %v\n", s.ID(), out.Name, member.Name)
+			return s.dialChecked(req, func(hostport string, ip net.IP) (net.Conn, error) {
+				return s.dialOutbound(member, hostport, ip)
+			})
+		})
+	}
+	return s.dialChecked(req, func(hostport string, ip net.IP) (net.Conn, error) {
+		return s.dialOutbound(out, hostport, ip)
+	})
+}
+
+// dialChecked dials the addresses req's rules were checked against in turn,
+// dialing the name would resolve it again,maybe to an address they deny.
+// Addresses the rules don't allow on their own are skipped,a rule matching
+// another address of the name may have let the request through.A name left
+// for an upstream proxy to resolve is dialed as it is.
+func (s *TCPConn) dialChecked(req *TCPRequest, dial func(hostport string, ip net.IP) (net.Conn, error)) (net.Conn, error) {
+	if len(req.targetIPs) == 0 {
+		return dial(req.hostport(), req.TargetAddr.IP)
+	}
+	port := strconv.Itoa(req.TargetAddr.Port)
+	ruleReq := s.ruleRequest(req)
+	firstErr := ERR_RULESET
+	tried := false
+	for _, ip := range req.targetIPs {
+		ruleReq.IPs = []net.IP{ip}
+		if !req.policy.evaluate(s.server.Rules, ruleReq) {
+			log.Printf("[ID:%v]%v SKIPPED %v OF %v\n", s.ID(), ERR_RULESET, ip, req.domain)
+			continue
+		}
+		conn, err := dial(net.JoinHostPort(ip.String(), port), ip)
+		if err == nil {
+			return conn, nil
+		}
+		if !tried {
+			firstErr, tried = err, true
 		}
+	}
+	return nil, firstErr
+}
+
+// dialOutbound connects to hostport through out,ip is its resolved address if known
+func (s *TCPConn) dialOutbound(out *Outbound, hostport string, ip net.IP) (net.Conn, error) {
+	switch out.Type {
+	case OutboundBlock:
+		return nil, ERR_ROUTE_BLOCKED
+	case OutboundProxy:
+		return s.dialUpstream(out.Proxy, out, hostport)
+	}
+	if s.server.Dialer != nil {
+		return s.dialCustom(out, hostport)
+	}
+	d, err := s.directDialer(out, ip)
+	if err != nil {
+		return nil, err
+	}
+	return d.Dial("tcp", hostport)
+}
+
+// TCPTransport relays traffic between client and remote until both directions
+// are finished.Once one side stops sending,the write half of its peer is
+// closed and the other direction keeps flowing,so half-closed connections
+// work through the proxy.The byte counters of session are kept up to date while
+// relaying,session may be nil.It returns the bytes sent by each side.
+func (s *TCPConn) TCPTransport(clientConn, remoteConn net.Conn, session *Session) (sent, received int64) {
+	if session == nil {
+		session = &Session{}
+	}
+	var up, down *rateLimiter
+	if limits := s.server.bandwidthLimiters(session.User, session.policy); limits != nil {
+		up, down = limits.up, limits.down
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		s.relay(clientConn, remoteConn, s.server.TargetIdleTimeout, &session.bytesReceived, down)
 	}()
 	go func() {
-		limit := TCPRETRY
-		clientConn.SetReadDeadline(time.Time{})
-		for {
-			// n, err := io.Copy(remoteConn, clientConn)
-			n, err := copyBuffer(remoteConn, clientConn)
-			if err != nil {
-				if errors.Is(err, io.EOF) ||
-					strings.Contains(err.Error(), "timeout") ||
-					strings.Contains(err.Error(), "closed") ||
-					limit <= 0 {
-					closeChan <- err
-					return
-				}
-				time.Sleep(time.Second * 5)
-				limit--
-				continue
-			}
-			if n == 0 {
-				time.Sleep(time.Second * 3)
-				continue
-			}
-			log.Printf("[ID:%v][TCP]client:%v send %v bytes -> remote:%v\n", s.ID(), clientConn.RemoteAddr(), n, remoteConn.RemoteAddr())
-		}
+		defer wg.Done()
+		s.relay(remoteConn, clientConn, s.server.ClientIdleTimeout, &session.bytesSent, up)
 	}()
+	wg.Wait()
+	return session.BytesSent(), session.BytesReceived()
+}
+
+// relay copies src to dst.A clean EOF from src is passed on as a half close of
+// dst,any other error tears down both connections to stop the opposite direction.
+// Writes to dst are throttled by limiter if it is not nil.
+func (s *TCPConn) relay(dst, src net.Conn, idle time.Duration, written *int64, limiter *rateLimiter) {
+	w := dst
+	if limiter != nil {
+		w = &limitedConn{Conn: dst, limiter: limiter}
+	}
+	_, err := copyBuffer(w, idleConn(src, idle), written)
+	if err != nil {
+		log.Printf("[ID:%v][TCP]%v -> %v: %v\n", s.ID(), src.RemoteAddr(), dst.RemoteAddr(), err)
+		src.Close()
+		dst.Close()
+		return
+	}
+	if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
 }
 
 /*
@@ -249,6 +390,7 @@ func (s *TCPConn) resolveAddress(conn net.Conn, req *TCPRequest) (err error) {
 			return err
 		}
 		IP = net.IP(dstAddrBytes)
+		req.targetIPs = []net.IP{IP}
 	case int(atypFQDN):
 		log.Printf("[ID:%v]ADDRESS TYPE: DOMAINNAME <- %v\n", s.ID(), conn.RemoteAddr())
 		hostLenByte := make([]byte, 1)
@@ -261,13 +403,8 @@ func (s *TCPConn) resolveAddress(conn net.Conn, req *TCPRequest) (err error) {
 		if err != nil {
 			return err
 		}
-		domain := string(hostBytes)
-		// IPAddrs, err := s.server.hostResolver.LookupIPAddr(context.Background(), domain)
-		IPAddrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), domain)
-		if err != nil {
-			return err
-		}
-		IP = IPAddrs[0].IP
+		//resolved by retarget,once hooks had a chance to send the request elsewhere
+		req.domain = string(hostBytes)
 	case int(atypIPV6):
 		log.Printf("[ID:%v]ADDRESS TYPE: IP V6 address <- %v\n", s.ID(), conn.RemoteAddr())
 		dstAddrBytes := make([]byte, 16)
@@ -276,6 +413,7 @@ func (s *TCPConn) resolveAddress(conn net.Conn, req *TCPRequest) (err error) {
 			return err
 		}
 		IP = net.IP(dstAddrBytes)
+		req.targetIPs = []net.IP{IP}
 	default:
 		return ERR_ADDRESS_TYPE
 	}
@@ -290,9 +428,66 @@ func (s *TCPConn) resolveAddress(conn net.Conn, req *TCPRequest) (err error) {
 		Port: dstPort,
 		Zone: "",
 	}
+	//UDP ASSOCIATE carries the client's address,not a destination
+	if req.cmd != CMD_UDP_ASSOCIATE {
+		s.rewriteTarget(req)
+	}
 	return
 }
 
+// rewriteTarget sends req where Server.Rewriter says
+func (s *TCPConn) rewriteTarget(req *TCPRequest) {
+	host := req.domain
+	if host == "" {
+		host = req.TargetAddr.IP.String()
+	}
+	toHost, toPort, rw := s.server.Rewriter.rewrite(host, req.TargetAddr.Port)
+	if rw == nil {
+		return
+	}
+	req.rewritten = rw.picksHost()
+	log.Printf("[ID:%v]REWRITE %v -> %v\n", s.ID(), req.hostport(), net.JoinHostPort(toHost, strconv.Itoa(toPort)))
+	req.domain, req.TargetAddr = "", &net.TCPAddr{IP: net.ParseIP(toHost), Port: toPort}
+	if req.TargetAddr.IP == nil {
+		req.domain = toHost
+	}
+}
+
+// retarget points req at hostport,resolving a host name unless an upstream
+// proxy resolves it
+func (s *TCPConn) retarget(req *TCPRequest, hostport string) error {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+	req.domain, req.targetIPs = "", nil
+	ip := net.ParseIP(host)
+	if ip == nil && req.cmd == CMD_CONNECT && s.server.remoteDNS() {
+		req.domain, req.TargetAddr = host, &net.TCPAddr{Port: port}
+		return nil
+	}
+	if ip == nil {
+		// IPAddrs, err := s.server.hostResolver.LookupIPAddr(context.Background(), host)
+		IPAddrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		if err != nil {
+			return err
+		}
+		ip = IPAddrs[0].IP
+		req.domain = host
+		for _, addr := range IPAddrs {
+			req.targetIPs = append(req.targetIPs, addr.IP)
+		}
+	} else {
+		req.targetIPs = []net.IP{ip}
+	}
+	req.TargetAddr = &net.TCPAddr{IP: ip, Port: port}
+	return nil
+}
+
 func setTCPOptions(conn *net.TCPConn) error {
 	// 设置 TCP keepalive
 	if err := conn.SetKeepAlive(true); err != nil {
@@ -314,14 +509,71 @@ func setTCPOptions(conn *net.TCPConn) error {
 	return conn.SetNoDelay(true)
 }
 
-func copyBuffer(dst net.Conn, src net.Conn) (int64, error) {
+// copyBuffer copies src to dst,adding the bytes written to *written as it goes.
+// When both ends are plain TCP connections the copy goes through
+// (*net.TCPConn).ReadFrom in chunks,which lets the kernel move the data
+// (splice(2) on Linux) without passing it through userspace.Wrapped connections
+// fall back to a pooled buffer,so setting Server.ClientIdleTimeout or
+// TargetIdleTimeout,or a bandwidth class limiting the user,silently turns the
+// zero-copy path off for the directions concerned.
+func copyBuffer(dst net.Conn, src net.Conn, written *int64) (int64, error) {
+	if dstTCP, ok := dst.(*net.TCPConn); ok {
+		if _, ok := src.(*net.TCPConn); ok {
+			var total int64
+			for {
+				chunk := &io.LimitedReader{R: src, N: spliceChunkSize}
+				n, err := dstTCP.ReadFrom(chunk)
+				total += n
+				atomic.AddInt64(written, n)
+				//a short chunk without error means src reached EOF
+				if err != nil || chunk.N > 0 {
+					return total, err
+				}
+			}
+		}
+	}
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
 
-	n, err := io.CopyBuffer(dst, src, buf)
+	//hide ReadFrom/WriteTo so io.CopyBuffer really uses the pooled buffer
+	return io.CopyBuffer(&countingWriter{Writer: dst, written: written}, readerOnly{src}, buf)
+}
+
+// spliceChunkSize is how much the zero-copy path moves between counter updates
+const spliceChunkSize = 1 << 20
+
+type countingWriter struct {
+	io.Writer
+	written *int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	atomic.AddInt64(w.written, int64(n))
 	return n, err
 }
 
+type readerOnly struct{ io.Reader }
+
+// idleReader pushes the read deadline forward before every read,so a read
+// only fails with a timeout once the peer has been silent for the whole period.
+type idleReader struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	r.Conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.Conn.Read(b)
+}
+
+func idleConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &idleReader{Conn: conn, timeout: timeout}
+}
+
 var bufferPool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 32*1024)
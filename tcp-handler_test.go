@@ -0,0 +1,184 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// readReply reads a reply of the server,its REP and BND.ADDR
+func readReply(t *testing.T, conn net.Conn) (byte, string) {
+	head := make([]byte, 3)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		t.Fatal(err)
+	}
+	host, port, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return head[1], net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// startBIND sends a BIND for peer and returns the connection and the address
+// the server listens on for the peer
+func startBIND(t *testing.T, s *Server, peer string) (net.Conn, string) {
+	listener := listenTest(t)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		(&TCPConn{server: s, conn: conn}).ServConn(conn)
+	}()
+	client := &Client{Addr: listener.Addr().String(), Timeout: 5 * time.Second}
+	conn, err := client.handshake(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := appendAddr([]byte{SOCKS5VERSION, CMD_BIND, 0}, peer)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	rep, bound := readReply(t, conn)
+	if rep != 0 {
+		t.Fatalf("first reply %v", rep)
+	}
+	return conn, bound
+}
+
+// dialFrom connects to addr from the loopback address source
+func dialFrom(t *testing.T, source, addr string) net.Conn {
+	d := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(source)}, Timeout: 5 * time.Second}
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestBIND(t *testing.T) {
+	s := newTestServer(t)
+	conn, bound := startBIND(t, s, "127.0.0.2:0")
+	defer conn.Close()
+
+	//a connection from another address than the announced one is dropped
+	stranger := dialFrom(t, "127.0.0.1", bound)
+	stranger.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := stranger.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("stranger not dropped: read %v bytes,%v", n, err)
+	}
+	stranger.Close()
+
+	peer := dialFrom(t, "127.0.0.2", bound)
+	defer peer.Close()
+	rep, addr := readReply(t, conn)
+	if rep != 0 || addr != peer.LocalAddr().String() {
+		t.Errorf("second reply %v %v,want 0 %v", rep, addr, peer.LocalAddr())
+	}
+	peer.Write([]byte("hello from the peer"))
+	peer.(*net.TCPConn).CloseWrite()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != "hello from the peer" {
+		t.Errorf("relayed %q,%v", data, err)
+	}
+}
+
+func TestBINDAllowAnyPeer(t *testing.T) {
+	s := newTestServer(t)
+	s.BindAllowAnyPeer = true
+	conn, bound := startBIND(t, s, "127.0.0.2:0")
+	defer conn.Close()
+	peer := dialFrom(t, "127.0.0.1", bound)
+	defer peer.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if rep, addr := readReply(t, conn); rep != 0 || addr != peer.LocalAddr().String() {
+		t.Errorf("second reply %v %v,want 0 %v", rep, addr, peer.LocalAddr())
+	}
+}
+
+func TestBINDTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.BindTimeout = 100 * time.Millisecond
+	conn, bound := startBIND(t, s, "127.0.0.2:0")
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if rep, _ := readReply(t, conn); rep != 1 {
+		t.Errorf("second reply %v,want 1 (general failure)", rep)
+	}
+	//the listener is gone
+	if peer, err := net.Dial("tcp", bound); err == nil {
+		peer.Close()
+		t.Error("BIND listener still open")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.HandshakeTimeout = 100 * time.Millisecond
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	//a client that sends nothing is dropped by the server,not by our deadline
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("silent client not dropped: read %v bytes,%v", n, err)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.ConnectTimeout = 100 * time.Millisecond
+	conn := &TCPConn{server: s}
+	d, err := conn.directDialer(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Timeout != s.ConnectTimeout || DEFAULT_TCP_DIALER.Timeout != 3*time.Second {
+		t.Errorf("dialer timeout %v,default %v", d.Timeout, DEFAULT_TCP_DIALER.Timeout)
+	}
+	//the dialer of an upstream chain is copied,not changed
+	custom := &net.Dialer{Timeout: time.Minute, KeepAlive: time.Second}
+	if d := s.tcpDialer(custom); d.Timeout != s.ConnectTimeout || d.KeepAlive != time.Second || custom.Timeout != time.Minute {
+		t.Errorf("upstream dialer %+v from %+v", d, custom)
+	}
+	s.ConnectTimeout = 0
+	if d, _ := conn.directDialer(nil, nil); d.Timeout != DEFAULT_TCP_DIALER.Timeout {
+		t.Errorf("dialer timeout %v without ConnectTimeout", d.Timeout)
+	}
+
+	//a destination that never answers fails the request once ConnectTimeout is up
+	s.ConnectTimeout = 100 * time.Millisecond
+	s.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.Serve(listener, nil)
+	client := &Client{Addr: listener.Addr().String(), Timeout: 5 * time.Second}
+	start := time.Now()
+	if conn, err := client.Dial("tcp", "192.0.2.1:80"); err == nil {
+		conn.Close()
+		t.Fatal("CONNECT succeeded")
+	} else if _, ok := err.(*RefusedError); !ok {
+		t.Errorf("got %v,want a refusal", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("refused after %v", elapsed)
+	}
+}
@@ -0,0 +1,281 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuthThrottle bans client IPs,and optionally user names,that fail to log in
+// too often.Every further ban of the same IP or user lasts twice as long as the
+// one before,up to MaxBanTime.IPv6 clients are counted and banned by /64,the
+// smallest network a client usually gets.
+type AuthThrottle struct {
+	// MaxIPFailures and MaxUserFailures are the failures allowed within Window
+	// per client IP and per user name before a ban,0 disables the check.User
+	// bans are off by default:anyone knowing a user name could lock that user
+	// out by sending bad passwords from a few addresses.
+	MaxIPFailures   int
+	MaxUserFailures int
+	Window          time.Duration
+	// BanTime is the length of the first ban,a MaxBanTime of 0 keeps all bans
+	// that long
+	BanTime    time.Duration
+	MaxBanTime time.Duration
+	// OnBan is called for every new ban,e.g. to feed a firewall.It runs on
+	// the connection's goroutine and should not block.
+	OnBan func(BanEvent)
+	// Size caps the IPs and users tracked,AUTH_THROTTLE_SIZE if zero.When it
+	// is full the quietest of a few sampled entries is forgotten.
+	Size int
+
+	locker  sync.Mutex
+	entries map[string]*throttleEntry
+	//time.Now unless set
+	clock func() time.Time
+}
+
+// BanEvent describes a new ban.
+type BanEvent struct {
+	// IP is the banned client address,nil if User is banned.For IPv6 the
+	// whole /64 of IP is banned.
+	IP net.IP
+	// User is the banned user name,empty if IP is banned
+	User     string
+	Failures int
+	Until    time.Time
+}
+
+type throttleEntry struct {
+	failures int
+	first    time.Time
+	last     time.Time
+	bans     int
+	until    time.Time
+}
+
+// NewAuthThrottle returns an AuthThrottle with the AUTH_* defaults,banning
+// client IPs only.
+func NewAuthThrottle() *AuthThrottle {
+	return &AuthThrottle{
+		MaxIPFailures: AUTH_MAX_IP_FAILURES,
+		Window:        AUTH_FAILURE_WINDOW,
+		BanTime:       AUTH_BAN_TIME,
+		MaxBanTime:    AUTH_MAX_BAN_TIME,
+	}
+}
+
+func (t *AuthThrottle) now() time.Time {
+	if t.clock != nil {
+		return t.clock()
+	}
+	return time.Now()
+}
+
+// Banned reports whether the client IP or the user name is banned,a nil
+// AuthThrottle bans nobody.
+func (t *AuthThrottle) Banned(ip net.IP, user string) bool {
+	if t == nil {
+		return false
+	}
+	now := t.now()
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for _, key := range t.keys(ip, user) {
+		if e := t.entries[key]; e != nil && now.Before(e.until) {
+			return true
+		}
+	}
+	return false
+}
+
+// Failure records a failed login and bans the IP or user once they reach
+// their limit.
+func (t *AuthThrottle) Failure(ip net.IP, user string) {
+	if t == nil {
+		return
+	}
+	var events []BanEvent
+	now := t.now()
+	t.locker.Lock()
+	if t.entries == nil {
+		t.entries = make(map[string]*throttleEntry)
+	}
+	if ip != nil && t.MaxIPFailures > 0 {
+		if e := t.fail(ipKey(ip), t.MaxIPFailures, now); e != nil {
+			events = append(events, BanEvent{IP: ip, Failures: e.failures, Until: e.until})
+			e.failures = 0
+		}
+	}
+	if user != "" && t.MaxUserFailures > 0 {
+		if e := t.fail("user:"+user, t.MaxUserFailures, now); e != nil {
+			events = append(events, BanEvent{User: user, Failures: e.failures, Until: e.until})
+			e.failures = 0
+		}
+	}
+	onBan := t.OnBan
+	t.locker.Unlock()
+	for _, ev := range events {
+		if ev.IP != nil {
+			log.Printf("AUTH BAN IP %v after %v failures until %v\n", ev.IP, ev.Failures, ev.Until.Format(time.RFC3339))
+		} else {
+			log.Printf("AUTH BAN USER %v after %v failures until %v\n", ev.User, ev.Failures, ev.Until.Format(time.RFC3339))
+		}
+		if onBan != nil {
+			onBan(ev)
+		}
+	}
+}
+
+// Success forgets the failures of user,those of the IP are kept so one valid
+// account can't be used to guess others.
+func (t *AuthThrottle) Success(user string) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	if e := t.entries["user:"+user]; e != nil {
+		e.failures = 0
+	}
+}
+
+// Unban lifts the bans and forgets the failures of ip and user,either may be empty.
+func (t *AuthThrottle) Unban(ip net.IP, user string) {
+	if t == nil {
+		return
+	}
+	t.locker.Lock()
+	defer t.locker.Unlock()
+	for _, key := range t.keys(ip, user) {
+		delete(t.entries, key)
+	}
+}
+
+// fail counts a failure for key and returns the entry if it got banned
+func (t *AuthThrottle) fail(key string, max int, now time.Time) *throttleEntry {
+	e := t.entries[key]
+	if e == nil {
+		size := t.Size
+		if size <= 0 {
+			size = AUTH_THROTTLE_SIZE
+		}
+		if len(t.entries) >= size {
+			t.evict(now)
+		}
+		e = &throttleEntry{}
+		t.entries[key] = e
+	}
+	if e.failures == 0 || now.Sub(e.first) > t.Window {
+		e.failures, e.first = 0, now
+	}
+	e.failures++
+	e.last = now
+	if e.failures < max || now.Before(e.until) {
+		return nil
+	}
+	ban := t.BanTime
+	for i := 0; i < e.bans && ban < t.MaxBanTime; i++ {
+		ban *= 2
+	}
+	if t.MaxBanTime > 0 && ban > t.MaxBanTime {
+		ban = t.MaxBanTime
+	}
+	e.bans++
+	e.until = now.Add(ban)
+	return e
+}
+
+// throttleEvictSamples is how many entries are looked at to pick one to forget
+const throttleEvictSamples = 8
+
+// evict forgets one entry to make room,among a few taken in map order,which is
+// random,one that isn't banned is preferred and then the one quiet the longest
+func (t *AuthThrottle) evict(now time.Time) {
+	var victim string
+	var victimEntry *throttleEntry
+	n := 0
+	for key, e := range t.entries {
+		if victimEntry == nil || e.forgetBefore(victimEntry, now) {
+			victim, victimEntry = key, e
+		}
+		if n++; n >= throttleEvictSamples {
+			break
+		}
+	}
+	delete(t.entries, victim)
+}
+
+// forgetBefore reports whether e should be forgotten rather than o
+func (e *throttleEntry) forgetBefore(o *throttleEntry, now time.Time) bool {
+	banned, oBanned := now.Before(e.until), now.Before(o.until)
+	if banned != oBanned {
+		return oBanned
+	}
+	return e.last.Before(o.last)
+}
+
+// ipKey is the entry of ip,IPv6 addresses are grouped by /64
+func ipKey(ip net.IP) string {
+	if ip.To4() == nil && len(ip) == net.IPv6len {
+		return "ip:" + ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+	}
+	return "ip:" + ip.String()
+}
+
+func (t *AuthThrottle) keys(ip net.IP, user string) []string {
+	keys := make([]string, 0, 2)
+	if ip != nil {
+		keys = append(keys, ipKey(ip))
+	}
+	if user != "" {
+		keys = append(keys, "user:"+user)
+	}
+	return keys
+}
+
+// ParseAuthThrottle parses comma separated settings,omitted ones keep their
+// defaults,user bans are only enabled by a user setting:
+//
+//	ip=5,user=10,window=5m,ban=1m,max_ban=1h
+//
+// "off" disables the throttle and returns nil.
+func ParseAuthThrottle(text string) (*AuthThrottle, error) {
+	if strings.TrimSpace(strings.ToLower(text)) == "off" {
+		return nil, nil
+	}
+	t := NewAuthThrottle()
+	for _, pair := range strings.Split(text, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid throttle setting %q", pair)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var err error
+		switch key {
+		case "ip":
+			t.MaxIPFailures, err = strconv.Atoi(value)
+		case "user":
+			t.MaxUserFailures, err = strconv.Atoi(value)
+		case "window":
+			t.Window, err = time.ParseDuration(value)
+		case "ban":
+			t.BanTime, err = time.ParseDuration(value)
+		case "max_ban":
+			t.MaxBanTime, err = time.ParseDuration(value)
+		default:
+			return nil, fmt.Errorf("unknown throttle setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid throttle setting %q", pair)
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,194 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// testThrottle returns a throttle whose clock only moves with the returned function
+func testThrottle() (*AuthThrottle, func(time.Duration)) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t := NewAuthThrottle()
+	t.clock = func() time.Time { return now }
+	return t, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestAuthThrottleIPBan(t *testing.T) {
+	throttle, advance := testThrottle()
+	var events []BanEvent
+	throttle.OnBan = func(ev BanEvent) { events = append(events, ev) }
+	ip, other := net.ParseIP("203.0.113.7"), net.ParseIP("203.0.113.8")
+
+	for i := 1; i < AUTH_MAX_IP_FAILURES; i++ {
+		throttle.Failure(ip, "alice")
+		if throttle.Banned(ip, "alice") {
+			t.Fatalf("banned after %v failures", i)
+		}
+	}
+	throttle.Failure(ip, "alice")
+	if !throttle.Banned(ip, "") || !throttle.Banned(ip, "bob") {
+		t.Fatal("IP not banned at the limit")
+	}
+	if throttle.Banned(other, "alice") {
+		t.Error("another IP is banned")
+	}
+	if len(events) != 1 || !events[0].IP.Equal(ip) || events[0].Failures != AUTH_MAX_IP_FAILURES {
+		t.Errorf("ban events %+v", events)
+	}
+
+	advance(AUTH_BAN_TIME - time.Second)
+	if !throttle.Banned(ip, "") {
+		t.Error("ban lifted early")
+	}
+	advance(time.Second)
+	if throttle.Banned(ip, "") {
+		t.Error("ban not lifted after BanTime")
+	}
+}
+
+func TestAuthThrottleWindow(t *testing.T) {
+	throttle, advance := testThrottle()
+	ip := net.ParseIP("203.0.113.7")
+	//failures spread wider than the window never add up to a ban
+	for i := 0; i < 3*AUTH_MAX_IP_FAILURES; i++ {
+		throttle.Failure(ip, "")
+		advance(AUTH_FAILURE_WINDOW/time.Duration(AUTH_MAX_IP_FAILURES-1) + time.Second)
+		if throttle.Banned(ip, "") {
+			t.Fatalf("banned after failure %v", i+1)
+		}
+	}
+}
+
+func TestAuthThrottleBackoff(t *testing.T) {
+	throttle, advance := testThrottle()
+	throttle.MaxBanTime = 4 * AUTH_BAN_TIME
+	ip := net.ParseIP("2001:db8::7")
+	for _, want := range []time.Duration{1, 2, 4, 4} {
+		for i := 0; i < AUTH_MAX_IP_FAILURES; i++ {
+			throttle.Failure(ip, "")
+		}
+		ban := want * AUTH_BAN_TIME
+		advance(ban - time.Second)
+		if !throttle.Banned(ip, "") {
+			t.Fatalf("ban shorter than %v", ban)
+		}
+		advance(time.Second)
+		if throttle.Banned(ip, "") {
+			t.Fatalf("ban longer than %v", ban)
+		}
+	}
+}
+
+func TestAuthThrottleFailuresDuringBan(t *testing.T) {
+	throttle, advance := testThrottle()
+	ip := net.ParseIP("203.0.113.7")
+	for i := 0; i < 3*AUTH_MAX_IP_FAILURES; i++ {
+		throttle.Failure(ip, "")
+	}
+	//failures during the ban neither extend it nor count as another ban
+	advance(AUTH_BAN_TIME)
+	if throttle.Banned(ip, "") {
+		t.Error("ban extended by failures while banned")
+	}
+}
+
+func TestAuthThrottleUserBans(t *testing.T) {
+	throttle, _ := testThrottle()
+	//off by default,so nobody can lock alice out
+	for i := 0; i < 100; i++ {
+		throttle.Failure(net.IPv4(198, 51, 100, byte(i)), "alice")
+	}
+	if throttle.Banned(net.ParseIP("203.0.113.7"), "alice") {
+		t.Fatal("user banned by default")
+	}
+
+	throttle, _ = testThrottle()
+	throttle.MaxIPFailures = 0
+	throttle.MaxUserFailures = 3
+	ip := net.ParseIP("203.0.113.7")
+	throttle.Failure(ip, "alice")
+	throttle.Failure(ip, "alice")
+	throttle.Success("alice")
+	throttle.Failure(ip, "alice")
+	throttle.Failure(ip, "alice")
+	if throttle.Banned(ip, "alice") {
+		t.Fatal("Success did not reset the failures of the user")
+	}
+	throttle.Failure(ip, "alice")
+	if !throttle.Banned(nil, "alice") || throttle.Banned(ip, "bob") {
+		t.Fatal("user not banned alone")
+	}
+	throttle.Unban(nil, "alice")
+	if throttle.Banned(ip, "alice") {
+		t.Error("Unban did not lift the ban")
+	}
+}
+
+func TestAuthThrottleNil(t *testing.T) {
+	var throttle *AuthThrottle
+	throttle.Failure(net.ParseIP("203.0.113.7"), "alice")
+	throttle.Success("alice")
+	if throttle.Banned(net.ParseIP("203.0.113.7"), "alice") {
+		t.Error("a nil throttle banned")
+	}
+}
+
+func TestParseAuthThrottle(t *testing.T) {
+	throttle, err := ParseAuthThrottle("ip=3, user=7,window=1m,ban=10s,max_ban=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if throttle.MaxIPFailures != 3 || throttle.MaxUserFailures != 7 || throttle.Window != time.Minute ||
+		throttle.BanTime != 10*time.Second || throttle.MaxBanTime != 5*time.Minute {
+		t.Errorf("parsed %+v", throttle)
+	}
+	if throttle, err = ParseAuthThrottle("window=1m"); err != nil || throttle.MaxUserFailures != 0 || throttle.MaxIPFailures != AUTH_MAX_IP_FAILURES {
+		t.Errorf("defaults not kept: %+v %v", throttle, err)
+	}
+	if throttle, err = ParseAuthThrottle(" OFF "); throttle != nil || err != nil {
+		t.Errorf("off: %+v %v", throttle, err)
+	}
+	for _, text := range []string{"ip", "ip=x", "ban=5", "color=red"} {
+		if _, err := ParseAuthThrottle(text); err == nil {
+			t.Errorf("%q accepted", text)
+		}
+	}
+}
+
+func TestAuthThrottleSize(t *testing.T) {
+	throttle, advance := testThrottle()
+	throttle.Size = 16
+	banned := net.ParseIP("203.0.113.7")
+	for i := 0; i < AUTH_MAX_IP_FAILURES; i++ {
+		throttle.Failure(banned, "")
+	}
+	//a client spraying addresses from many networks
+	for i := 0; i < 1000; i++ {
+		advance(time.Millisecond)
+		throttle.Failure(net.ParseIP(fmt.Sprintf("2001:db8:%x::1", i)), "")
+		if len(throttle.entries) > throttle.Size {
+			t.Fatalf("throttle grew to %v entries", len(throttle.entries))
+		}
+	}
+	if !throttle.Banned(banned, "") {
+		t.Error("a banned IP was forgotten before idle ones")
+	}
+}
+
+func TestAuthThrottleIPv6Prefix(t *testing.T) {
+	throttle, _ := testThrottle()
+	for i := 0; i < AUTH_MAX_IP_FAILURES; i++ {
+		throttle.Failure(net.ParseIP(fmt.Sprintf("2001:db8:1:2::%x", i+1)), "")
+	}
+	if !throttle.Banned(net.ParseIP("2001:db8:1:2:ffff::1"), "") {
+		t.Error("failures from one /64 not counted together")
+	}
+	if throttle.Banned(net.ParseIP("2001:db8:1:3::1"), "") {
+		t.Error("the next /64 is banned too")
+	}
+	if len(throttle.entries) != 1 {
+		t.Errorf("%v entries for one /64", len(throttle.entries))
+	}
+}
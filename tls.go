@@ -0,0 +1,150 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate and key from PEM files and loads them
+// again when they change,e.g. after a renewal.
+type CertReloader struct {
+	certFile, keyFile string
+	locker            sync.RWMutex
+	cert              *tls.Certificate
+	certMod, keyMod   time.Time
+	stop              chan struct{}
+}
+
+// NewCertReloader loads the certificate and key.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again,the old certificate stays in use if they are invalid.
+func (r *CertReloader) Reload() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.locker.Lock()
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	r.locker.Unlock()
+	return nil
+}
+
+// Watch reloads the files whenever one of them is modified,checking every
+// interval until Close is called.
+func (r *CertReloader) Watch(interval time.Duration) {
+	r.locker.Lock()
+	if r.stop != nil {
+		r.locker.Unlock()
+		return
+	}
+	r.stop = make(chan struct{})
+	stop := r.stop
+	r.locker.Unlock()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			certMod, keyMod, err := r.modTimes()
+			if err != nil {
+				log.Printf("tls certificate %v: %v", r.certFile, err)
+				continue
+			}
+			r.locker.RLock()
+			changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+			r.locker.RUnlock()
+			if !changed {
+				continue
+			}
+			//a renewal may write the certificate and the key one after another,
+			//a failed attempt is repeated on the next tick
+			if err := r.Reload(); err != nil {
+				log.Printf("tls certificate reload failed: %v", err)
+				continue
+			}
+			log.Printf("tls certificate %v reloaded", r.certFile)
+		}
+	}()
+}
+
+// Close stops watching the files.
+func (r *CertReloader) Close() {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+// GetCertificate is meant for tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return r.cert, nil
+}
+
+func (r *CertReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	info, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	certMod = info.ModTime()
+	if info, err = os.Stat(r.keyFile); err != nil {
+		return
+	}
+	return certMod, info.ModTime(), nil
+}
+
+// NewTLSConfig returns a server TLS config serving the certificate of certs.
+// With a clientCAFile clients must present a certificate signed by one of its
+// CAs,see ListenerOptions.CertIdentity.
+func NewTLSConfig(certs *CertReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := LoadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+	}
+	return config, nil
+}
+
+// LoadCertPool reads the PEM certificates in path.
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %v", path)
+	}
+	return pool, nil
+}
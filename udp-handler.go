@@ -2,10 +2,14 @@ package socks5
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -53,10 +57,16 @@ func AssembleHeader(data []byte, addr *net.UDPAddr) *bytes.Buffer {
 	 | 2 | 1 | 1 | Variable | 2 | Variable |
 	 +----+------+------+----------+----------+----------+*/
 func TrimHeader(dataBuf *bytes.Buffer) (frag byte, dstIP *net.IP, dstPort int) {
+	frag, _, dstIP, dstPort = trimHeader(dataBuf)
+	return
+}
+
+// trimHeader is TrimHeader that also returns the requested domain name,if any
+func trimHeader(dataBuf *bytes.Buffer) (frag byte, domain string, dstIP *net.IP, dstPort int) {
 	// Each UDP datagram carries a UDP request   header with it:
 
 	//RSV
-	dataBuf.ReadByte()
+	dataBuf.Next(2)
 	//FRAG
 	frag, err := dataBuf.ReadByte()
 	if err != nil {
@@ -89,15 +99,12 @@ func TrimHeader(dataBuf *bytes.Buffer) (frag byte, dstIP *net.IP, dstPort int) {
 		if err != nil {
 			return
 		}
-		addrs, err := net.LookupHost(string(domainNameBytes))
-		if err != nil {
-			return
-		}
-		ipAddr, err := net.ResolveIPAddr("tcp", addrs[0])
-		if err != nil {
-			return
+		domain = string(domainNameBytes)
+		//a name that doesn't resolve is left to the rewrites,dstIP stays nil
+		if addrs, err := net.LookupHost(domain); err == nil {
+			d := net.ParseIP(addrs[0])
+			dstIP = &d
 		}
-		dstIP = &ipAddr.IP
 	case int(atypIPV6):
 		//ipv6
 		b := make([]byte, 16)
@@ -120,16 +127,31 @@ func TrimHeader(dataBuf *bytes.Buffer) (frag byte, dstIP *net.IP, dstPort int) {
 	return
 }
 
-func (s *Server) handleUDPReplie(relayConn *net.UDPConn, request *UDPRequest, done chan struct{}) {
+// handleUDPReplie relays datagrams from the remote side back to the client until
+// the remote has been silent for UDP_SESSION_TIMEOUT or the request is closed.
+func (s *Server) handleUDPReplie(relayConn *net.UDPConn, request *UDPRequest) {
 	b := make([]byte, MAXUDPDATA)
-	request.remoteConn.SetReadDeadline(time.Now().Add(3 * time.Second))
-	close(done)
+	limits := s.bandwidthLimiters(request.user, request.policy)
 	for {
-		n, _, err := request.remoteConn.ReadFromUDP(b)
+		request.remoteConn.SetReadDeadline(time.Now().Add(UDP_SESSION_TIMEOUT))
+		n, err := request.remoteConn.Read(b)
+		data := b[:n]
+		if n > 0 && request.upstream != nil {
+			//the upstream relay prefixes the header of the remote address
+			reply := bytes.NewBuffer(data)
+			if frag, _, dstIP, _ := trimHeader(reply); dstIP == nil || frag != 0 {
+				continue
+			}
+			data = reply.Bytes()
+			n = len(data)
+		}
 		if n > 0 {
-			dataBuf := AssembleHeader(b[:n], request.remoteAddr)
-			relayConn.WriteMsgUDP(dataBuf.Bytes(), nil, request.clientAddr)
-			log.Printf("[UDP] remote:%v -> client:%v, bytes:%d\n", request.remoteAddr, request.clientAddr, n)
+			if limits != nil {
+				limits.down.wait(n)
+			}
+			relayConn.WriteMsgUDP(request.replyHeader(data).Bytes(), nil, request.clientAddr)
+			atomic.AddInt64(&request.session.bytesReceived, int64(n))
+			log.Printf("[ID:%v][UDP] remote:%v -> client:%v, bytes:%d\n", request.session.ID, request.remoteAddr, request.clientAddr, n)
 		} else if err != nil {
 			if err == io.EOF ||
 				strings.Contains(err.Error(), "timeout") ||
@@ -140,13 +162,20 @@ func (s *Server) handleUDPReplie(relayConn *net.UDPConn, request *UDPRequest, do
 	}
 	s.locker.Lock()
 	request.remoteConn.Close()
-	delete(s.UDPRequestMap, request.clientAddr.String())
+	if request.upstream != nil {
+		request.upstream.Close()
+	}
+	delete(s.UDPRequestMap, request.key)
 	s.locker.Unlock()
-	// 缺少会话超时清理机制
-	// 可能导致内存泄漏
+	//a forwarded client's session is its only request
+	if request.raw {
+		s.Sessions.Remove(request.session.ID)
+		s.hookClose(request.session)
+		log.Printf("[ID:%v][UDP]FORWARD CLOSED client sent %v bytes,remote sent %v bytes\n", request.session.ID, request.session.BytesSent(), request.session.BytesReceived())
+	}
 }
 
-func (s *Server) processUDPDategrams(request *UDPRequest, dataBuf *bytes.Buffer, frag byte, b []byte, remoteConn *net.UDPConn) {
+func (s *Server) processUDPDategrams(request *UDPRequest, dataBuf *bytes.Buffer, frag byte, b []byte) {
 	switch {
 	//data was fragmented,save data into queue
 	case int(frag) > request.position:
@@ -154,13 +183,18 @@ func (s *Server) processUDPDategrams(request *UDPRequest, dataBuf *bytes.Buffer,
 		request.reassemblyQueue = append(request.reassemblyQueue, dataBuf.Bytes()...)
 
 	case frag == 0:
+		if limits := s.bandwidthLimiters(request.user, request.policy); limits != nil {
+			limits.up.wait(len(request.reassemblyQueue) + dataBuf.Len())
+		}
 		if len(request.reassemblyQueue) > 0 {
-			remoteConn.Write(request.reassemblyQueue)
+			request.write(request.reassemblyQueue)
+			atomic.AddInt64(&request.session.bytesSent, int64(len(request.reassemblyQueue)))
 			request.reassemblyQueue = []byte{}
 			request.position = 0
 		}
-		remoteConn.Write(dataBuf.Bytes())
-		log.Printf("[UDP] client:%v -> remote:%v, bytes:%d\n", request.clientAddr, remoteConn.RemoteAddr(), len(b))
+		request.write(dataBuf.Bytes())
+		atomic.AddInt64(&request.session.bytesSent, int64(dataBuf.Len()))
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v, bytes:%d\n", request.session.ID, request.clientAddr, request.remoteAddr, len(b))
 	case int(frag) < request.position:
 		log.Printf("[UDP] Ignoring outdated or duplicate fragment from client:%v\n", request.clientAddr)
 		request.reassemblyQueue = []byte{}
@@ -171,36 +205,312 @@ func (s *Server) processUDPDategrams(request *UDPRequest, dataBuf *bytes.Buffer,
 // UDPTransport handle UDP traffic
 func (s *Server) UDPTransport(relayConn *net.UDPConn, clientAddr *net.UDPAddr, b []byte) {
 	dataBuf := bytes.NewBuffer(b)
-	frag, dstIP, dstPort := TrimHeader(dataBuf)
-	remoteAddr := &net.UDPAddr{
-		IP:   *dstIP,
-		Port: dstPort,
-		Zone: "",
-	}
-	//udp dial
-	remoteConn, err := net.DialUDP("udp", nil, remoteAddr)
+	frag, domain, dstIP, dstPort := trimHeader(dataBuf)
+	if dstIP == nil && domain == "" {
+		log.Printf("[UDP] Invalid datagram header from client:%v\n", clientAddr)
+		return
+	}
+	target := &udpTarget{domain: domain, reply: &net.UDPAddr{Port: dstPort}}
+	if dstIP != nil {
+		target.reply.IP = *dstIP
+	}
+	session := s.udpSession(clientAddr)
+	if session == nil {
+		log.Printf("[UDP] client:%v -> remote:%v %v\n", clientAddr, target, ERR_UDP_NO_ASSOC)
+		return
+	}
+	if err := s.rewriteUDP(session, target); err != nil {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, target, err)
+		return
+	}
+	domain, remoteAddr := target.domain, target.remote
+	ruleRequest := &RuleRequest{
+		Command: CMD_UDP_ASSOCIATE,
+		Domain:  domain,
+		IPs:     []net.IP{remoteAddr.IP},
+		Port:    remoteAddr.Port,
+		Client:  clientAddr.IP,
+		User:    session.User,
+	}
+	if !session.policy.evaluate(s.Rules, ruleRequest) {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, remoteAddr, ERR_RULESET)
+		return
+	}
+	guard := s.Egress
+	if target.rewritten {
+		guard = guard.rewritten()
+	}
+	if err := guard.Check(remoteAddr.IP, remoteAddr.Port); err != nil {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, remoteAddr, err)
+		return
+	}
+	if err := s.hookUDPDatagram(session, remoteAddr, domain, dataBuf.Len()); err != nil {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, remoteAddr, err)
+		return
+	}
+	out := s.Router.Route(ruleRequest)
+	if out != nil && out.Type == OutboundBlock {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, remoteAddr, ERR_ROUTE_BLOCKED)
+		return
+	}
+	request, err := s.udpRequest(relayConn, session, out, clientAddr, target)
 	if err != nil {
+		log.Printf("[ID:%v][UDP] client:%v -> remote:%v %v\n", session.ID, clientAddr, remoteAddr, err)
 		return
 	}
-	//if request is existed
+	s.processUDPDategrams(request, dataBuf, frag, b)
+}
+
+// udpTarget is where a datagram goes
+type udpTarget struct {
+	//host name of the destination,if any
+	domain string
+	remote *net.UDPAddr
+	//the destination as the client sent it,replies carry it in their header.
+	//replyDomain is set for rewritten names.
+	reply       *net.UDPAddr
+	replyDomain string
+	//the host was picked by Server.Rewriter,see EgressGuard.rewritten
+	rewritten bool
+	//port forward,datagrams go without the SOCKS5 header both ways
+	raw bool
+}
+
+func (t *udpTarget) String() string {
+	if t.replyDomain != "" {
+		return net.JoinHostPort(t.replyDomain, strconv.Itoa(t.reply.Port))
+	}
+	if t.reply.IP == nil {
+		return net.JoinHostPort(t.domain, strconv.Itoa(t.reply.Port))
+	}
+	return t.reply.String()
+}
+
+// key identifies the relay of clientAddr to t,by the destination the client
+// sent to so replies carry that one.Forwards have relays of their own.
+func (t *udpTarget) key(relayConn *net.UDPConn, clientAddr *net.UDPAddr) string {
+	key := clientAddr.String() + "->" + t.String()
+	if t.raw {
+		key = relayConn.LocalAddr().String() + " " + key
+	}
+	return key
+}
+
+// rewriteUDP applies Server.Rewriter to target and resolves where it goes
+func (s *Server) rewriteUDP(session *Session, target *udpTarget) error {
+	host := target.domain
+	if host == "" {
+		host = target.reply.IP.String()
+	}
+	target.remote = target.reply
+	toHost, toPort, rw := s.Rewriter.rewrite(host, target.reply.Port)
+	if rw == nil {
+		if target.reply.IP == nil {
+			return fmt.Errorf("lookup %v failed", target.domain)
+		}
+		return nil
+	}
+	log.Printf("[ID:%v][UDP]REWRITE %v -> %v\n", session.ID, target, net.JoinHostPort(toHost, strconv.Itoa(toPort)))
+	if target.domain != "" {
+		target.replyDomain = target.domain
+	}
+	target.domain, target.rewritten = "", rw.picksHost()
+	target.remote = &net.UDPAddr{IP: net.ParseIP(toHost), Port: toPort}
+	if target.remote.IP == nil {
+		addrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), toHost)
+		if err != nil {
+			return err
+		}
+		target.domain, target.remote.IP = toHost, addrs[0].IP
+	}
+	return nil
+}
+
+// udpSession returns the UDP ASSOCIATE session datagrams from clientAddr belong to
+func (s *Server) udpSession(clientAddr *net.UDPAddr) *Session {
+	key := clientAddr.String()
+	s.locker.RLock()
+	session := s.udpClients[key]
+	s.locker.RUnlock()
+	if session != nil {
+		return session
+	}
+	session = s.Sessions.udpAssociation(clientAddr)
+	if session != nil {
+		s.locker.Lock()
+		s.udpClients[key] = session
+		s.locker.Unlock()
+	}
+	return session
+}
+
+// udpRequest returns the relay state of client -> remote.On first use the
+// remote side is dialed through out and a reader for its replies is started.
+func (s *Server) udpRequest(relayConn *net.UDPConn, session *Session, out *Outbound, clientAddr *net.UDPAddr, target *udpTarget) (*UDPRequest, error) {
+	key := target.key(relayConn, clientAddr)
+	s.locker.RLock()
+	request, exists := s.UDPRequestMap[key]
+	s.locker.RUnlock()
+	if exists {
+		return request, nil
+	}
+	//dialed without holding the lock,an upstream association takes a few round trips
+	remoteConn, upstream, err := s.dialUDP(session, out, target.domain, target.remote)
+	if err != nil {
+		return nil, err
+	}
 	s.locker.Lock()
-	request, exists := s.UDPRequestMap[clientAddr.String()]
-	if !exists {
-		request = &UDPRequest{
-			clientAddr:      clientAddr,
-			remoteConn:      remoteConn,
-			remoteAddr:      remoteAddr,
-			reassemblyQueue: []byte{},
-			position:        0,
+	defer s.locker.Unlock()
+	if request, exists := s.UDPRequestMap[key]; exists {
+		remoteConn.Close()
+		if upstream != nil {
+			upstream.Close()
 		}
-		s.UDPRequestMap[clientAddr.String()] = request
+		return request, nil
 	}
-	s.locker.Unlock()
-	//UDPRequestChan <- request
-	LaunchReplyChan := make(chan struct{})
+	request = &UDPRequest{
+		clientAddr:      clientAddr,
+		remoteConn:      remoteConn,
+		remoteAddr:      target.remote,
+		replyAddr:       target.reply,
+		replyDomain:     target.replyDomain,
+		raw:             target.raw,
+		upstream:        upstream,
+		reassemblyQueue: []byte{},
+		position:        0,
+		key:             key,
+		session:         session,
+		user:            session.User,
+		policy:          session.policy,
+	}
+	s.UDPRequestMap[key] = request
 	//read remote data,transfer to client
-	go s.handleUDPReplie(relayConn, request, LaunchReplyChan)
-	<-LaunchReplyChan
+	go s.handleUDPReplie(relayConn, request)
+	if upstream != nil {
+		go watchAssociation(upstream, remoteConn)
+	}
+	return request, nil
+}
+
+// dialUDP connects a UDP socket for remoteAddr through out,or Upstream if out
+// is nil.Through a proxy the socket goes to its relay and the control
+// connection of the association is returned as well.
+func (s *Server) dialUDP(session *Session, out *Outbound, domain string, remoteAddr *net.UDPAddr) (net.Conn, net.Conn, error) {
+	if out == nil {
+		return s.dialUDPOutbound(session, nil, domain, remoteAddr)
+	}
+	log.Printf("[ID:%v][UDP]ROUTE %v -> OUTBOUND %v\n", session.ID, remoteAddr, out.Name)
+	if out.Type != OutboundPool {
+		return s.dialUDPOutbound(session, out, domain, remoteAddr)
+	}
+	var conn, upstream net.Conn
+	client, _ := addrIPPort(session.Client)
+	err := out.Pool.try(client, func(m *poolMember) error {
+		var err error
+		conn, upstream, err = s.dialUDPOutbound(session, m.out, domain, remoteAddr)
+		return err
+	})
+	return conn, upstream, err
+}
 
-	s.processUDPDategrams(request, dataBuf, frag, b, remoteConn)
+// dialUDPOutbound is dialUDP for an outbound that is not a pool
+func (s *Server) dialUDPOutbound(session *Session, out *Outbound, domain string, remoteAddr *net.UDPAddr) (net.Conn, net.Conn, error) {
+	ctx, cancel := s.dialContext(&DialRequest{
+		Command:  CMD_UDP_ASSOCIATE,
+		User:     session.User,
+		Identity: session.Identity,
+		Client:   session.Client,
+		Domain:   domain,
+		Outbound: out,
+	})
+	defer cancel()
+	source := out.source()
+	if source == nil {
+		source = session.policy.egressSource()
+	}
+	if source == nil {
+		source = s.Source
+	}
+	var listener net.IP
+	if session.clientConn != nil {
+		listener, _ = addrIPPort(session.clientConn.LocalAddr())
+	}
+	chain := s.Upstream
+	if out != nil {
+		chain = out.Proxy
+	}
+	if chain != nil {
+		return s.udpAssociate(ctx, chain, source, listener)
+	}
+	var d PacketDialer = s.PacketDialer
+	if d == nil {
+		nd := &net.Dialer{}
+		if err := source.apply(nd, "udp", listener, remoteAddr.IP); err != nil {
+			return nil, nil, err
+		}
+		d = nd
+	}
+	conn, err := d.DialContext(ctx, "udp", remoteAddr.String())
+	return conn, nil, err
+}
+
+// udpAssociate opens a UDP association with the last hop of chain,leaving
+// the host from source unless Server.Dialer and PacketDialer take over
+func (s *Server) udpAssociate(ctx context.Context, chain *ProxyChain, source *EgressSource, listener net.IP) (net.Conn, net.Conn, error) {
+	d := s.tcpDialer(chain.Dialer)
+	ud := &net.Dialer{}
+	if err := source.apply(&d, "tcp", listener, nil); err != nil {
+		return nil, nil, err
+	}
+	if err := source.apply(ud, "udp", listener, nil); err != nil {
+		return nil, nil, err
+	}
+	var control Dialer = &d
+	if s.Dialer != nil {
+		control = s.Dialer
+	}
+	var relay PacketDialer = ud
+	if s.PacketDialer != nil {
+		relay = s.PacketDialer
+	}
+	return chain.associate(ctx, control, relay)
+}
+
+// replyHeader prefixes a reply with the header of the destination the client sent to
+func (r *UDPRequest) replyHeader(data []byte) *bytes.Buffer {
+	if r.raw {
+		return bytes.NewBuffer(data)
+	}
+	if r.replyDomain == "" {
+		return AssembleHeader(data, r.replyAddr)
+	}
+	header := bytes.NewBuffer([]byte{0, 0, 0, atypFQDN, byte(len(r.replyDomain))})
+	header.WriteString(r.replyDomain)
+	header.Write([]byte{byte(r.replyAddr.Port >> 8), byte(r.replyAddr.Port & 0xff)})
+	header.Write(data)
+	return header
+}
+
+// write sends a datagram to the remote side,through the upstream relay if there is one
+func (r *UDPRequest) write(b []byte) (int, error) {
+	if r.upstream != nil {
+		b = AssembleHeader(b, r.remoteAddr).Bytes()
+	}
+	return r.remoteConn.Write(b)
+}
+
+// closeUDPRequests ends the relays of a UDP association once its TCP connection is gone
+func (s *Server) closeUDPRequests(session *Session) {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, request := range s.UDPRequestMap {
+		if request.session == session {
+			request.remoteConn.Close()
+		}
+	}
+	for key, client := range s.udpClients {
+		if client == session {
+			delete(s.udpClients, key)
+		}
+	}
 }
@@ -0,0 +1,221 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// WebhookAuth delegates username/password checks to an HTTP endpoint.Every
+// check POSTs
+//
+//	{"username":"alice","password":"secret","client_ip":"203.0.113.7"}
+//
+// and expects a 200 response with
+//
+//	{"allow":true,"policy":"cmd=connect;max_sessions=4","attributes":{"team":"ops"}}
+//
+// where policy is optional and in ParseUserPolicy syntax,attributes are copied
+// to the Identity.Decisions are cached per user,password and client IP.
+type WebhookAuth struct {
+	URL string
+	// Header is added to every request,e.g. an Authorization token
+	Header http.Header
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+	// Timeout bounds a single check,WEBHOOK_TIMEOUT if zero
+	Timeout time.Duration
+	// FailOpen admits users when the endpoint can't be reached or answers
+	// with an error,by default they are refused
+	FailOpen bool
+	// CacheTTL and NegativeCacheTTL keep allowed and refused decisions,
+	// zero disables the respective cache
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+	// CacheSize caps the cached decisions,WEBHOOK_CACHE_SIZE if zero
+	CacheSize int
+
+	locker sync.Mutex
+	cache  map[string]webhookDecision
+}
+
+type webhookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	ClientIP string `json:"client_ip,omitempty"`
+}
+
+type webhookResponse struct {
+	Allow      bool              `json:"allow"`
+	Policy     string            `json:"policy,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+type webhookDecision struct {
+	//nil if refused
+	identity *Identity
+	expires  time.Time
+}
+
+// NewWebhookAuth returns a fail-closed WebhookAuth for url caching decisions
+// for WEBHOOK_CACHE_TTL.
+func NewWebhookAuth(url string) *WebhookAuth {
+	return &WebhookAuth{
+		URL:              url,
+		CacheTTL:         WEBHOOK_CACHE_TTL,
+		NegativeCacheTTL: WEBHOOK_CACHE_TTL,
+	}
+}
+
+// Authenticate asks the endpoint about the user's password.
+func (w *WebhookAuth) Authenticate(ctx context.Context, req AuthRequest) (*Identity, error) {
+	if req.Method != AUTH_USERNAME_PASSWORD {
+		return nil, ERR_AUTH_FAILED
+	}
+	var clientIP string
+	if ip, _ := addrIPPort(req.Client); ip != nil {
+		clientIP = ip.String()
+	}
+
+	key := webhookCacheKey(req.Username, req.Password, clientIP)
+	d, ok := w.cached(key)
+	if !ok {
+		var err error
+		if d, err = w.check(ctx, req.Username, req.Password, clientIP); err != nil {
+			if !w.FailOpen {
+				return nil, fmt.Errorf("auth webhook %v: %v", w.URL, err)
+			}
+			log.Printf("auth webhook %v: %v,failing open", w.URL, err)
+			return &Identity{User: req.Username}, nil
+		}
+		w.store(key, d)
+	}
+	if d.identity == nil {
+		return nil, ERR_AUTH_FAILED
+	}
+	return d.identity, nil
+}
+
+func (w *WebhookAuth) check(ctx context.Context, user, pwd, clientIP string) (webhookDecision, error) {
+	body, err := json.Marshal(&webhookRequest{Username: user, Password: pwd, ClientIP: clientIP})
+	if err != nil {
+		return webhookDecision{}, err
+	}
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = WEBHOOK_TIMEOUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return webhookDecision{}, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range w.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return webhookDecision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return webhookDecision{}, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	var result webhookResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return webhookDecision{}, err
+	}
+	var d webhookDecision
+	if result.Allow {
+		d.identity = &Identity{User: user, Attributes: result.Attributes}
+		if result.Policy != "" {
+			if d.identity.Policy, err = ParseUserPolicy(result.Policy); err != nil {
+				return webhookDecision{}, err
+			}
+		}
+	}
+	return d, nil
+}
+
+func (w *WebhookAuth) cached(key string) (webhookDecision, bool) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	d, ok := w.cache[key]
+	if !ok {
+		return d, false
+	}
+	if time.Now().After(d.expires) {
+		delete(w.cache, key)
+		return d, false
+	}
+	return d, true
+}
+
+func (w *WebhookAuth) store(key string, d webhookDecision) {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	ttl := w.NegativeCacheTTL
+	if d.identity != nil {
+		ttl = w.CacheTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	now := time.Now()
+	if w.cache == nil {
+		w.cache = make(map[string]webhookDecision)
+	}
+	size := w.CacheSize
+	if size <= 0 {
+		size = WEBHOOK_CACHE_SIZE
+	}
+	if _, ok := w.cache[key]; !ok && len(w.cache) >= size {
+		w.evict(now)
+	}
+	d.expires = now.Add(ttl)
+	w.cache[key] = d
+}
+
+// webhookEvictSamples is how many cached decisions are looked at to pick one to drop
+const webhookEvictSamples = 8
+
+// evict drops one decision to make room,an expired one or the one expiring
+// first among a few taken in map order,which is random
+func (w *WebhookAuth) evict(now time.Time) {
+	var victim string
+	var earliest time.Time
+	n := 0
+	for k, v := range w.cache {
+		if now.After(v.expires) {
+			victim = k
+			break
+		}
+		if victim == "" || v.expires.Before(earliest) {
+			victim, earliest = k, v.expires
+		}
+		if n++; n >= webhookEvictSamples {
+			break
+		}
+	}
+	delete(w.cache, victim)
+}
+
+// webhookCacheKey hashes the credentials so the cache holds no plaintext passwords
+func webhookCacheKey(user, pwd, clientIP string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + pwd + "\x00" + clientIP))
+	return hex.EncodeToString(sum[:])
+}
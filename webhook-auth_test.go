@@ -0,0 +1,166 @@
+package socks5
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// webhookStub answers like an auth service:alice/secret is allowed with a
+// policy,"slow" and "broken" trigger a timeout and a 500
+func webhookStub(t *testing.T, calls *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("bad webhook request: %v", err)
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch req.Username {
+		case "slow":
+			time.Sleep(200 * time.Millisecond)
+		case "broken":
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		resp := webhookResponse{Allow: req.Username == "alice" && req.Password == "secret" && req.ClientIP == "203.0.113.7"}
+		if resp.Allow {
+			resp.Policy = "cmd=connect"
+			resp.Attributes = map[string]string{"team": "ops"}
+		}
+		json.NewEncoder(rw).Encode(&resp)
+	}))
+}
+
+func webhookLogin(w *WebhookAuth, user, password string) (*Identity, error) {
+	return w.Authenticate(context.Background(), AuthRequest{
+		Method:   AUTH_USERNAME_PASSWORD,
+		Username: user,
+		Password: password,
+		Client:   &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+	})
+}
+
+func TestWebhookAuth(t *testing.T) {
+	var calls int32
+	server := webhookStub(t, &calls)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		failOpen bool
+		allowed  bool
+		authErr  bool
+	}{
+		{"allow", "alice", "secret", false, true, false},
+		{"deny", "alice", "wrong", false, false, true},
+		{"timeout", "slow", "secret", false, false, false},
+		{"timeout fail open", "slow", "secret", true, true, false},
+		{"5xx", "broken", "secret", false, false, false},
+		{"5xx fail open", "broken", "secret", true, true, false},
+		{"deny fail open", "bob", "secret", true, false, true},
+	}
+	for _, tt := range tests {
+		w := NewWebhookAuth(server.URL)
+		w.Header = http.Header{"Authorization": {"Bearer token"}}
+		w.Timeout = 50 * time.Millisecond
+		w.FailOpen = tt.failOpen
+		identity, err := webhookLogin(w, tt.user, tt.password)
+		switch {
+		case tt.allowed:
+			if err != nil || identity == nil || identity.User != tt.user {
+				t.Errorf("%v: refused: %v", tt.name, err)
+			}
+		case tt.authErr:
+			if err != ERR_AUTH_FAILED {
+				t.Errorf("%v: got %v,want ERR_AUTH_FAILED", tt.name, err)
+			}
+		default:
+			if err == nil || err == ERR_AUTH_FAILED {
+				t.Errorf("%v: got %v,want an error of the webhook", tt.name, err)
+			}
+		}
+	}
+
+	w := NewWebhookAuth(server.URL)
+	w.Header = http.Header{"Authorization": {"Bearer token"}}
+	identity, err := webhookLogin(w, "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Policy == nil || identity.Policy.allowCommand(CMD_BIND) || identity.Attributes["team"] != "ops" {
+		t.Errorf("policy or attributes missing: %+v", identity)
+	}
+}
+
+func TestWebhookAuthCache(t *testing.T) {
+	var calls int32
+	server := webhookStub(t, &calls)
+	defer server.Close()
+	w := NewWebhookAuth(server.URL)
+	w.Header = http.Header{"Authorization": {"Bearer token"}}
+	w.NegativeCacheTTL = 50 * time.Millisecond
+
+	//cache hit
+	for i := 0; i < 3; i++ {
+		if _, err := webhookLogin(w, "alice", "secret"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("allowed decision not cached,%v calls", n)
+	}
+
+	//negative cache and its expiry
+	atomic.StoreInt32(&calls, 0)
+	for i := 0; i < 3; i++ {
+		if _, err := webhookLogin(w, "alice", "wrong"); err != ERR_AUTH_FAILED {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("refused decision not cached,%v calls", n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, err := webhookLogin(w, "alice", "wrong"); err != ERR_AUTH_FAILED {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("expired decision still used,%v calls", n)
+	}
+
+	//errors are never cached
+	atomic.StoreInt32(&calls, 0)
+	webhookLogin(w, "broken", "secret")
+	webhookLogin(w, "broken", "secret")
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("error cached,%v calls", n)
+	}
+}
+
+func TestWebhookAuthCacheSize(t *testing.T) {
+	w := &WebhookAuth{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute, CacheSize: 16}
+	for i := 0; i < 1000; i++ {
+		w.store(webhookCacheKey("mallory", fmt.Sprint(i), "203.0.113.7"), webhookDecision{})
+		if len(w.cache) > w.CacheSize {
+			t.Fatalf("cache grew to %v entries", len(w.cache))
+		}
+	}
+	//the newest decision is kept
+	if _, ok := w.cached(webhookCacheKey("mallory", "999", "203.0.113.7")); !ok {
+		t.Error("newest decision evicted")
+	}
+}
@@ -0,0 +1,154 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebSocketTunnelHalfClose(t *testing.T) {
+	target := halfCloseTarget(t)
+	defer target.Close()
+	s := newTestServer(t)
+	wsListener := listenTest(t)
+	defer wsListener.Close()
+	go s.ServeWebSocket(wsListener, "/socks", nil)
+	tunnel := &WebSocketTunnel{URL: "ws://" + wsListener.Addr().String() + "/socks"}
+	local := listenTest(t)
+	defer local.Close()
+	go tunnel.Serve(local)
+
+	client := &Client{Addr: local.Addr().String(), Timeout: 5 * time.Second}
+	for _, msg := range []string{"hello", ""} {
+		conn, err := client.Dial("tcp", target.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		//the target only answers once the end of the request got through
+		if got := roundTrip(t, conn, msg); got != "reply:"+msg {
+			t.Errorf("got %q,want %q", got, "reply:"+msg)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebSocketHandshakeTimeout(t *testing.T) {
+	s := newTestServer(t)
+	s.HandshakeTimeout = 100 * time.Millisecond
+	listener := listenTest(t)
+	defer listener.Close()
+	go s.ServeWebSocket(listener, "/socks", nil)
+
+	//a client that never sends the upgrade request
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("silent client not dropped: read %v bytes,%v", n, err)
+	}
+
+	//a kept alive connection idling after a request that wasn't an upgrade
+	conn, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("GET /other HTTP/1.1\r\nHost: proxy\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Close {
+		t.Fatalf("response %v,close %v", resp.Status, resp.Close)
+	}
+	if n, err := reader.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Errorf("idle connection not dropped: read %v bytes,%v", n, err)
+	}
+}
+
+// connectProxy is an HTTP CONNECT proxy
+func connectProxy(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		if buf.Reader.Buffered() > 0 {
+			t.Error("data sent before the CONNECT response")
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipeConns(conn, target)
+	})
+}
+
+func TestProxyChainHTTPS(t *testing.T) {
+	target := halfCloseTarget(t)
+	defer target.Close()
+	proxy := httptest.NewTLSServer(connectProxy(t))
+	defer proxy.Close()
+
+	chain, err := ParseProxyChain("https://" + proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hop := chain.Hops[0]
+	if hop.Type != "http" || hop.TLS == nil {
+		t.Fatalf("https:// parsed as %+v", hop)
+	}
+	//the certificate of httptest is for 127.0.0.1,the default ServerName
+	hop.TLS.RootCAs = proxy.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := chain.DialContext(ctx, "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if got := roundTrip(t, conn, "hello"); got != "reply:hello" {
+		t.Errorf("got %q through the https proxy", got)
+	}
+
+	//a plain http:// hop fails the TLS proxy instead of leaking the request
+	plain, err := ParseProxyChain("http://" + proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := plain.DialContext(ctx, "tcp", target.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("CONNECT in plain text accepted by a TLS proxy")
+	}
+	//and an untrusted certificate is refused
+	untrusted, _ := ParseProxyChain("https://" + proxy.Listener.Addr().String())
+	if conn, err := untrusted.DialContext(ctx, "tcp", target.Addr().String()); err == nil {
+		conn.Close()
+		t.Error("untrusted proxy certificate accepted")
+	}
+}